@@ -1,78 +1,249 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"io"
+	"math"
+	"model-hub/config"
+	"model-hub/helper"
 	"model-hub/models"
 	"model-hub/workers"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// attemptsHeader is the number of workers a prediction request was sent to.
+	attemptsHeader = "X-Model-Hub-Attempts"
+	// modelHeader is the model that served a prediction request.
+	modelHeader = "X-Model-Hub-Model"
+	// variantHeader is the variant a traffic split chose for a prediction request.
+	variantHeader = "X-Model-Hub-Variant"
 )
 
 type Handlers struct {
-	manager *workers.WorkerManager
-	logger  *zap.Logger
+	manager         *workers.WorkerManager
+	apiKeys         map[string]config.APIKey
+	priorityClasses config.PriorityClasses
+	logger          *zap.Logger
 }
 
-func NewHandlers(manager *workers.WorkerManager, logger *zap.Logger) *Handlers {
-	return &Handlers{manager: manager, logger: logger}
+func NewHandlers(manager *workers.WorkerManager, cfg *config.Config, logger *zap.Logger) *Handlers {
+	apiKeys := make(map[string]config.APIKey)
+	for _, apiKey := range cfg.APIKeys {
+		apiKeys[apiKey.Key] = apiKey
+	}
+	return &Handlers{manager: manager, apiKeys: apiKeys, priorityClasses: cfg.PriorityClasses, logger: logger}
 }
 
-func (h *Handlers) PredictHandler(c *gin.Context) {
-	apiKey := os.Getenv("API_KEY")
+// authorize checks the X-API-KEY header against the expected key. An empty key disables the check.
+func (h *Handlers) authorize(c *gin.Context, apiKey string) bool {
 	if apiKey != "" {
 		clientAPIKey := c.GetHeader("X-API-KEY")
 		if clientAPIKey != apiKey {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			return
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeRequired is authorize for endpoints that must not be open: they are
+// refused until a key is configured in setting.
+func (h *Handlers) authorizeRequired(c *gin.Context, apiKey string, setting string) bool {
+	if apiKey == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("disabled until %s is set", setting)})
+		return false
+	}
+	return h.authorize(c, apiKey)
+}
+
+// authorizeAdmin checks the key of admin requests that change what is served.
+// They are refused unless ADMIN_API_KEY or API_KEY is set.
+func (h *Handlers) authorizeAdmin(c *gin.Context) bool {
+	return h.authorizeRequired(c, helper.GetEnv("ADMIN_API_KEY", os.Getenv("API_KEY")), "ADMIN_API_KEY")
+}
+
+// authorizeClient checks the key of a prediction request against API_KEY and the
+// configured api_keys, and returns the configured key. API_KEY has no tenant or limits.
+func (h *Handlers) authorizeClient(c *gin.Context) (config.APIKey, bool) {
+	apiKey := os.Getenv("API_KEY")
+	if apiKey == "" && len(h.apiKeys) == 0 {
+		return config.APIKey{}, true
+	}
+	clientAPIKey := c.GetHeader("X-API-KEY")
+	if clientKey, ok := h.apiKeys[clientAPIKey]; ok {
+		return clientKey, true
+	}
+	if apiKey != "" && clientAPIKey == apiKey {
+		return config.APIKey{}, true
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	return config.APIKey{}, false
+}
+
+// resolvePriority returns the priority of a request, given as a number or a class
+// name, or the model default. Priorities above the cap of the API key are clamped
+// or rejected, the model default is always clamped.
+func (h *Handlers) resolvePriority(c *gin.Context, req models.PredictEnvelope, model models.ModelName, key config.APIKey) (int, bool) {
+	var priority int
+	requested := true
+	switch value := req.Params.Priority.(type) {
+	case float64:
+		priority = int(value)
+	case string:
+		var err error
+		priority, err = h.priorityClasses.Resolve(config.PriorityValue(value))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return 0, false
+		}
+	default:
+		requested = false
+		priority = 1
+		if modelConfig, ok := h.manager.ModelConfig(model); ok {
+			// validated on load
+			priority, _ = h.priorityClasses.Resolve(modelConfig.DefaultPriority)
 		}
 	}
+	if key.MaxPriority == "" {
+		return priority, true
+	}
+	maxPriority, _ := h.priorityClasses.Resolve(key.MaxPriority)
+	if priority <= maxPriority {
+		return priority, true
+	}
+	if requested && key.OnExceed == config.OnExceedReject {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("priority %d exceeds the maximum of %d allowed for the API key", priority, maxPriority)})
+		return 0, false
+	}
+	h.logger.Debug(fmt.Sprintf("Priority %d of tenant %s clamped to %d", priority, key.Tenant, maxPriority))
+	return maxPriority, true
+}
+
+func (h *Handlers) PredictHandler(c *gin.Context) {
+	key, ok := h.authorizeClient(c)
+	if !ok {
+		return
+	}
 
 	debug := os.Getenv("DEBUG")
-	var req models.PredictRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+	// Only the routing parameters are decoded, the body is forwarded to the worker as is
+	var req models.PredictEnvelope
+	if err := json.Unmarshal(body, &req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decode request body"})
 		return
 	}
 	if debug == "1" {
-		h.logger.Info("Received request", zap.Any("request_body", req))
+		h.logger.Info("Received request", zap.ByteString("request_body", body))
 	}
-	modelString, ok := req.Params["model"].(string)
+	modelString, ok := req.Params.Model.(string)
 	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model parameter is missing or has an invalid format"})
 		return
 	}
-	priorityRaw, ok := req.Params["priority"].(float64)
+	model := models.ModelName(modelString)
+	priority, ok := h.resolvePriority(c, req, model, key)
 	if !ok {
-		priorityRaw = 1
+		return
+	}
+	// the tenant of the API key can not be overridden by the request
+	tenant := key.Tenant
+	if tenant == "" {
+		tenant, _ = req.Params.Tenant.(string)
+	}
+	var deadline time.Time
+	if deadlineRaw, ok := req.Params.Deadline.(string); ok {
+		deadline, err = time.Parse(time.RFC3339, deadlineRaw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "deadline parameter must be an RFC 3339 timestamp"})
+			return
+		}
 	}
-	priority := int(priorityRaw)
-	model := models.ModelName(modelString)
 
-	worker, err := h.manager.GetAvailableWorker(model, priority)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get available worker"})
+	result, err := h.manager.Predict(c.Request.Context(), model, workers.RequestOptions{
+		Priority:   priority,
+		Tenant:     tenant,
+		Deadline:   deadline,
+		RoutingKey: routingKey(req.Params.RoutingKey),
+	}, body)
+	var predictErr *workers.PredictError
+	if errors.As(err, &predictErr) {
+		c.Header(attemptsHeader, strconv.Itoa(predictErr.Attempts))
+		if predictErr.Variant != "" {
+			c.Header(variantHeader, string(predictErr.Variant))
+		}
+	}
+	var circuitErr *workers.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		retryAfter := int(math.Ceil(circuitErr.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": circuitErr.Error()})
 		return
 	}
-
-	preds, err := worker.Predict(req)
-	h.manager.SetWorkerAvailable(worker.ID)
-	h.logComplete(ok, req, priority)
-	if debug == "1" {
-		h.logger.Info("Sending response", zap.Any("response_body", preds))
+	if errors.Is(err, workers.ErrTenantLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("too many requests for tenant %s", tenant)})
+		return
 	}
 	if err != nil {
+		h.logComplete(req, priority)
 		c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, preds)
+	c.Header(attemptsHeader, strconv.Itoa(result.Attempts))
+	c.Header(modelHeader, string(result.Model))
+	if result.Variant != "" {
+		c.Header(variantHeader, string(result.Variant))
+	}
+	if debug == "1" {
+		respBody, err := io.ReadAll(result.Body)
+		result.Body.Close()
+		h.manager.ReleaseWorker(result.Worker.ID)
+		h.logComplete(req, priority)
+		h.logger.Info("Sending response", zap.ByteString("response_body", respBody))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("worker %s: failed to read response body: %v", result.Worker.ID, err)})
+			return
+		}
+		c.Data(http.StatusOK, result.ContentType, respBody)
+		return
+	}
+
+	// Stream the worker response to the client unchanged
+	c.DataFromReader(http.StatusOK, result.ContentLength, result.ContentType, result.Body, nil)
+	result.Body.Close()
+	h.manager.ReleaseWorker(result.Worker.ID)
+	h.logComplete(req, priority)
+}
+
+// routingKey returns the routing_key parameter as a string, numbers are accepted as well.
+func routingKey(value interface{}) string {
+	switch key := value.(type) {
+	case string:
+		return key
+	case float64:
+		return strconv.FormatFloat(key, 'f', -1, 64)
+	}
+	return ""
 }
 
-func (h *Handlers) logComplete(ok bool, req models.PredictRequest, priority int) {
+func (h *Handlers) logComplete(req models.PredictEnvelope, priority int) {
 	var info string
-	metadata, ok := req.Params["metadata"].(string)
+	metadata, ok := req.Params.Metadata.(string)
 	if ok {
 		info = fmt.Sprintf("%v. ", metadata)
 	}
@@ -94,6 +265,215 @@ func (h *Handlers) ModelReady(c *gin.Context) {
 		return
 	}
 
-	h.manager.SetWorkerAvailable(data.WorkerId)
+	h.manager.WorkerReady(data.WorkerId)
 	c.Status(http.StatusOK)
 }
+
+// RegisterWorker adds a remote worker to a model. Registered workers must call it
+// again periodically as a heartbeat, otherwise they are removed. Registration is
+// disabled while no key is configured, as registered workers receive predictions.
+func (h *Handlers) RegisterWorker(c *gin.Context) {
+	if !h.authorizeRequired(c, helper.GetEnv("WORKER_REGISTRATION_KEY", os.Getenv("API_KEY")), "WORKER_REGISTRATION_KEY") {
+		return
+	}
+
+	var data struct {
+		Model    models.ModelName `json:"model"`
+		Endpoint string           `json:"endpoint"`
+	}
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to unmarshal request body"})
+		return
+	}
+
+	workerID, err := h.manager.RegisterRemoteWorker(data.Model, data.Endpoint)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"worker_id": workerID})
+}
+
+func (h *Handlers) WorkersStatus(c *gin.Context) {
+	if !h.authorize(c, os.Getenv("API_KEY")) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"workers": h.manager.WorkersStatus()})
+}
+
+func (h *Handlers) TenantsStatus(c *gin.Context) {
+	if !h.authorize(c, os.Getenv("API_KEY")) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"models": h.manager.TenantsStatus()})
+}
+
+func (h *Handlers) ModelsStatus(c *gin.Context) {
+	if !h.authorize(c, os.Getenv("API_KEY")) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"models": h.manager.ModelsStatus()})
+}
+
+func (h *Handlers) Aliases(c *gin.Context) {
+	if !h.authorize(c, os.Getenv("API_KEY")) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"aliases": h.manager.Aliases()})
+}
+
+// SetAlias retargets an alias such as sentiment@canary to another version of the model.
+func (h *Handlers) SetAlias(c *gin.Context) {
+	if !h.authorizeAdmin(c) {
+		return
+	}
+
+	var data struct {
+		Model models.ModelName `json:"model"`
+	}
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to unmarshal request body"})
+		return
+	}
+
+	alias := models.ModelName(c.Param("alias"))
+	if err := h.manager.SetAlias(alias, data.Model); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alias": alias, "model": data.Model})
+}
+
+// StartCanary moves the traffic of an alias progressively to another version of the model.
+func (h *Handlers) StartCanary(c *gin.Context) {
+	if !h.authorizeAdmin(c) {
+		return
+	}
+
+	var data struct {
+		Model models.ModelName `json:"model"`
+	}
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to unmarshal request body"})
+		return
+	}
+
+	status, err := h.manager.StartCanary(models.ModelName(c.Param("alias")), data.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, status)
+}
+
+func (h *Handlers) CanaryStatus(c *gin.Context) {
+	if !h.authorize(c, os.Getenv("API_KEY")) {
+		return
+	}
+	status, ok := h.manager.Canary(models.ModelName(c.Param("alias")))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no canary of the alias"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// AbortCanary rolls back the running canary of an alias.
+func (h *Handlers) AbortCanary(c *gin.Context) {
+	if !h.authorizeAdmin(c) {
+		return
+	}
+	status, err := h.manager.AbortCanary(models.ModelName(c.Param("alias")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// StartRollout replaces the workers of a model with workers using a new path or handler.
+func (h *Handlers) StartRollout(c *gin.Context) {
+	if !h.authorizeAdmin(c) {
+		return
+	}
+
+	var data struct {
+		Path    string            `json:"path"`
+		Handler string            `json:"handler"`
+		Timeout string            `json:"timeout"`
+		Warmup  []json.RawMessage `json:"warmup"`
+	}
+
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to unmarshal request body"})
+		return
+	}
+	for _, path := range []string{data.Path, data.Handler} {
+		if path != "" && !rolloutAllowed(path) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s is outside of ROLLOUT_DIRS", path)})
+			return
+		}
+	}
+	options := workers.RolloutOptions{Path: data.Path, Handler: data.Handler, Warmup: data.Warmup}
+	if data.Timeout != "" {
+		timeout, err := time.ParseDuration(data.Timeout)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must be a duration such as 5m"})
+			return
+		}
+		options.Timeout = timeout
+	}
+
+	status, err := h.manager.StartRollout(models.ModelName(c.Param("name")), options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, status)
+}
+
+// rolloutAllowed reports whether a rollout path or handler lies in one of the
+// ROLLOUT_DIRS directories. Any path is allowed if ROLLOUT_DIRS is not set.
+func rolloutAllowed(path string) bool {
+	dirs := os.Getenv("ROLLOUT_DIRS")
+	if dirs == "" {
+		return true
+	}
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, dir := range filepath.SplitList(dirs) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handlers) RolloutStatus(c *gin.Context) {
+	if !h.authorize(c, os.Getenv("API_KEY")) {
+		return
+	}
+	status, ok := h.manager.Rollout(models.ModelName(c.Param("name")))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no rollout of the model"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
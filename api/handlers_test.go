@@ -0,0 +1,649 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"model-hub/config"
+	"model-hub/models"
+	"model-hub/test/fixtures"
+	"model-hub/workers"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// startEndpoint serves a remote worker answering predictions with predict.
+func startEndpoint(t testing.TB, predict http.HandlerFunc) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/predict", predict)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// echo answers a prediction with its request body.
+func echo(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// startHub loads the configuration, starts its workers and returns the handlers in front of them.
+func startHub(t testing.TB, configYAML string) *Handlers {
+	t.Helper()
+	t.Setenv("METRICS_DISPLAY_FREQUENCY", "3600")
+	cfg, err := config.Load(writeConfig(t, configYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := workers.NewWorkerManager(cfg, zap.NewNop())
+	manager.Initialize()
+	deadline := time.Now().Add(5 * time.Second)
+	for !workersLoaded(manager) {
+		if time.Now().After(deadline) {
+			t.Fatal("workers did not become ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	gin.SetMode(gin.ReleaseMode)
+	return NewHandlers(manager, cfg, zap.NewNop())
+}
+
+// writeConfig writes the configuration to a file and returns its path.
+func writeConfig(t testing.TB, configYAML string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func workersLoaded(manager *workers.WorkerManager) bool {
+	for _, worker := range manager.WorkersStatus() {
+		if !worker.Loaded {
+			return false
+		}
+	}
+	return true
+}
+
+// predict sends a prediction request through the handler.
+func predict(h *Handlers, body string, header http.Header) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.POST("/predict", h.PredictHandler)
+	request := httptest.NewRequest(http.MethodPost, "/predict", bytes.NewBufferString(body))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// waitForTenant waits until the tenant of model m has queued and running requests.
+func waitForTenant(t *testing.T, h *Handlers, tenant string, queued int, running int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, status := range h.manager.TenantsStatus()["m"] {
+			if status.Tenant == tenant && status.Queued == queued && status.Running == running {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tenant %s did not reach %d queued and %d running requests", tenant, queued, running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPredictTenantQueueLimit(t *testing.T) {
+	release := make(chan struct{})
+	endpoint := startEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		echo(w, r)
+	})
+	h := startHub(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+    tenants:
+      "*": {max_queued: 1}
+`, endpoint))
+
+	const body = `{"instances":[1],"parameters":{"model":"m","tenant":"batch"}}`
+	done := make(chan int, 2)
+	go func() { done <- predict(h, body, nil).Code }()
+	waitForTenant(t, h, "batch", 0, 1)
+	go func() { done <- predict(h, body, nil).Code }()
+	waitForTenant(t, h, "batch", 1, 1)
+
+	if code := predict(h, body, nil).Code; code != http.StatusTooManyRequests {
+		t.Errorf("request over max_queued: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// other tenants have their own limit
+	go func() { done <- predict(h, `{"instances":[1],"parameters":{"model":"m","tenant":"search"}}`, nil).Code }()
+	waitForTenant(t, h, "search", 1, 0)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("queued request: status %d, want %d", code, http.StatusOK)
+		}
+	}
+}
+
+func TestPredictTenantConcurrencyLimit(t *testing.T) {
+	for _, scheduler := range []string{config.SchedulerPriority, config.SchedulerFIFO, config.SchedulerEDF, config.SchedulerFair} {
+		t.Run(scheduler, func(t *testing.T) {
+			release := make(chan struct{})
+			endpoint := startEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				echo(w, r)
+			})
+			h := startHub(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s", "%s"]
+    scheduler: "%s"
+    tenants:
+      batch: {max_concurrent: 1}
+`, endpoint, endpoint, scheduler))
+
+			const body = `{"instances":[1],"parameters":{"model":"m","tenant":"batch"}}`
+			done := make(chan int, 2)
+			go func() { done <- predict(h, body, nil).Code }()
+			waitForTenant(t, h, "batch", 0, 1)
+
+			// a worker is idle, but the tenant is at its limit
+			if code := predict(h, body, nil).Code; code != http.StatusTooManyRequests {
+				t.Errorf("request over max_concurrent: status %d, want %d", code, http.StatusTooManyRequests)
+			}
+			go func() { done <- predict(h, `{"instances":[1],"parameters":{"model":"m","tenant":"search"}}`, nil).Code }()
+			waitForTenant(t, h, "search", 0, 1)
+
+			close(release)
+			for i := 0; i < 2; i++ {
+				if code := <-done; code != http.StatusOK {
+					t.Errorf("request within the limit: status %d, want %d", code, http.StatusOK)
+				}
+			}
+		})
+	}
+}
+
+func TestResolvePriority(t *testing.T) {
+	h := startHub(t, fmt.Sprintf(`
+priority_classes: {batch: 1, interactive: 5, realtime: 10}
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+    default_priority: "realtime"
+`, startEndpoint(t, echo)))
+	capped := config.APIKey{Tenant: "web", MaxPriority: "interactive", OnExceed: config.OnExceedClamp}
+	strict := config.APIKey{Tenant: "jobs", MaxPriority: "interactive", OnExceed: config.OnExceedReject}
+	tests := []struct {
+		name     string
+		priority string
+		key      config.APIKey
+		want     int
+		status   int
+	}{
+		{name: "number", priority: `3`, want: 3},
+		{name: "class", priority: `"batch"`, want: 1},
+		{name: "unknown class", priority: `"urgent"`, status: http.StatusBadRequest},
+		{name: "model default", want: 10},
+		{name: "below the cap", priority: `"batch"`, key: strict, want: 1},
+		{name: "clamped to the cap", priority: `9`, key: capped, want: 5},
+		{name: "rejected over the cap", priority: `"realtime"`, key: strict, status: http.StatusForbidden},
+		{name: "model default is always clamped", key: strict, want: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req models.PredictEnvelope
+			body := `{"parameters":{"model":"m"}}`
+			if test.priority != "" {
+				body = `{"parameters":{"model":"m","priority":` + test.priority + `}}`
+			}
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			priority, ok := h.resolvePriority(c, req, "m", test.key)
+			if test.status != 0 {
+				if ok || recorder.Code != test.status {
+					t.Errorf("status %d, want %d", recorder.Code, test.status)
+				}
+				return
+			}
+			if !ok || priority != test.want {
+				t.Errorf("priority %d (ok %t), want %d", priority, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestPredictPriorityCapRejected(t *testing.T) {
+	h := startHub(t, fmt.Sprintf(`
+priority_classes: {batch: 1, realtime: 10}
+api_keys:
+  - {key: "jobs-key", tenant: "jobs", max_priority: "batch", on_exceed: "reject"}
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+`, startEndpoint(t, echo)))
+	header := http.Header{"X-Api-Key": {"jobs-key"}}
+	if code := predict(h, `{"instances":[1],"parameters":{"model":"m","priority":"realtime"}}`, header).Code; code != http.StatusForbidden {
+		t.Errorf("priority over the cap: status %d, want %d", code, http.StatusForbidden)
+	}
+	if code := predict(h, `{"instances":[1],"parameters":{"model":"m","priority":"batch"}}`, header).Code; code != http.StatusOK {
+		t.Errorf("priority within the cap: status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestPredictAttemptsHeader(t *testing.T) {
+	h := startHub(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+`, startEndpoint(t, echo)))
+	recorder := predict(h, `{"instances":[1],"parameters":{"model":"m"}}`, nil)
+	if recorder.Code != http.StatusOK || recorder.Header().Get(attemptsHeader) != "1" {
+		t.Errorf("status %d with %s %q, want %d with 1 attempt", recorder.Code, attemptsHeader, recorder.Header().Get(attemptsHeader), http.StatusOK)
+	}
+}
+
+func TestPredictRetriedOnUnreachableWorker(t *testing.T) {
+	// both workers load, then stop accepting connections
+	var servers []*httptest.Server
+	var endpoints []string
+	for i := 0; i < 2; i++ {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+		mux.HandleFunc("/predict", echo)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+		endpoints = append(endpoints, fmt.Sprintf("%q", server.URL))
+	}
+	h := startHub(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: [%s]
+    retries: 1
+`, strings.Join(endpoints, ", ")))
+	for _, server := range servers {
+		server.Close()
+	}
+
+	recorder := predict(h, `{"instances":[1],"parameters":{"model":"m"}}`, nil)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+	if attempts := recorder.Header().Get(attemptsHeader); attempts != "2" {
+		t.Errorf("%s %q, want 2", attemptsHeader, attempts)
+	}
+	if retries := h.manager.ModelsStatus()[0].Retries; retries != 1 {
+		t.Errorf("%d retries counted, want 1", retries)
+	}
+}
+
+func TestPredictNotRetriedAfterReachingWorker(t *testing.T) {
+	var calls atomic.Int32
+	// the worker dies while it serves the request
+	broken := func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}
+	h := startHub(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s", "%s"]
+`, startEndpoint(t, broken), startEndpoint(t, broken)))
+
+	recorder := predict(h, `{"instances":[1],"parameters":{"model":"m"}}`, nil)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+	if attempts := recorder.Header().Get(attemptsHeader); attempts != "1" || calls.Load() != 1 {
+		t.Errorf("%s %q with %d calls, want a single attempt", attemptsHeader, attempts, calls.Load())
+	}
+}
+
+func TestPredictCircuitOpen(t *testing.T) {
+	h := startHub(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+    circuit_breaker: {window: 2, open_for: 30s}
+`, startEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken model", http.StatusInternalServerError)
+	})))
+	const body = `{"instances":[1],"parameters":{"model":"m"}}`
+	for i := 0; i < 2; i++ {
+		if code := predict(h, body, nil).Code; code != http.StatusInternalServerError {
+			t.Fatalf("failing request: status %d, want %d", code, http.StatusInternalServerError)
+		}
+	}
+	recorder := predict(h, body, nil)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("request to an open breaker: status %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Retry-After %q, want 30", retryAfter)
+	}
+}
+
+// failing answers every prediction with an error and counts the calls.
+func failing(calls *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "broken model", http.StatusInternalServerError)
+	}
+}
+
+func TestPredictFallbackChain(t *testing.T) {
+	var aCalls, bCalls atomic.Int32
+	h := startHub(t, fmt.Sprintf(`
+models:
+  a:
+    name: "a"
+    runtime: "remote"
+    endpoints: ["%s"]
+    retries: 0
+    fallback: [b, c]
+  b:
+    name: "b"
+    runtime: "remote"
+    endpoints: ["%s"]
+    retries: 0
+  c:
+    name: "c"
+    runtime: "remote"
+    endpoints: ["%s"]
+`, startEndpoint(t, failing(&aCalls)), startEndpoint(t, failing(&bCalls)), startEndpoint(t, echo)))
+
+	recorder := predict(h, `{"instances":[1],"parameters":{"model":"a"}}`, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if model := recorder.Header().Get(modelHeader); model != "c" {
+		t.Errorf("%s %q, want c", modelHeader, model)
+	}
+	if attempts := recorder.Header().Get(attemptsHeader); attempts != "3" {
+		t.Errorf("%s %q, want 3", attemptsHeader, attempts)
+	}
+	if aCalls.Load() != 1 || bCalls.Load() != 1 {
+		t.Errorf("a called %d and b %d times, want once each in chain order", aCalls.Load(), bCalls.Load())
+	}
+	// a model without fallbacks serves its own requests
+	if model := predict(h, `{"instances":[1],"parameters":{"model":"c"}}`, nil).Header().Get(modelHeader); model != "c" {
+		t.Errorf("%s %q, want c", modelHeader, model)
+	}
+}
+
+func TestPredictFallbackCycle(t *testing.T) {
+	var aCalls, bCalls atomic.Int32
+	h := startHub(t, fmt.Sprintf(`
+models:
+  a:
+    name: "a"
+    runtime: "remote"
+    endpoints: ["%s"]
+    retries: 0
+    fallback: [b]
+  b:
+    name: "b"
+    runtime: "remote"
+    endpoints: ["%s"]
+    retries: 0
+    fallback: [a]
+`, startEndpoint(t, failing(&aCalls)), startEndpoint(t, failing(&bCalls))))
+
+	// the fallbacks of a fallback model are not followed
+	if code := predict(h, `{"instances":[1],"parameters":{"model":"a"}}`, nil).Code; code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", code, http.StatusInternalServerError)
+	}
+	if aCalls.Load() != 1 || bCalls.Load() != 1 {
+		t.Errorf("a called %d and b %d times, want once each", aCalls.Load(), bCalls.Load())
+	}
+
+	_, err := config.Load(writeConfig(t, `
+models:
+  a:
+    name: "a"
+    runtime: "remote"
+    endpoints: ["http://localhost:1"]
+    fallback: [a]
+`))
+	if err == nil {
+		t.Error("model falling back to itself accepted")
+	}
+}
+
+func TestPredictVariantHeader(t *testing.T) {
+	h := startHub(t, fmt.Sprintf(`
+models:
+  a:
+    name: "a"
+    runtime: "remote"
+    endpoints: ["%s"]
+  b:
+    name: "b"
+    runtime: "remote"
+    endpoints: ["%s"]
+  ab:
+    name: "ab"
+    split:
+      - {model: "a", weight: 1}
+      - {model: "b", weight: 1}
+`, startEndpoint(t, echo), startEndpoint(t, echo)))
+
+	const body = `{"instances":[1],"parameters":{"model":"ab","routing_key":"user-42"}}`
+	first := predict(h, body, nil)
+	variant := first.Header().Get(variantHeader)
+	if first.Code != http.StatusOK || (variant != "a" && variant != "b") {
+		t.Fatalf("status %d with %s %q, want %d with a or b", first.Code, variantHeader, variant, http.StatusOK)
+	}
+	if model := first.Header().Get(modelHeader); model != variant {
+		t.Errorf("%s %q, want the variant %q", modelHeader, model, variant)
+	}
+	for i := 0; i < 10; i++ {
+		if got := predict(h, body, nil).Header().Get(variantHeader); got != variant {
+			t.Fatalf("request with the same routing key sent to %q, want %q", got, variant)
+		}
+	}
+	if got := predict(h, `{"instances":[1],"parameters":{"model":"a"}}`, nil).Header().Get(variantHeader); got != "" {
+		t.Errorf("%s %q for a model without a split, want none", variantHeader, got)
+	}
+}
+
+// runCanary starts a canary of s@2 behind s@stable and sends requests to the alias until it finished.
+func runCanary(t *testing.T, candidate http.HandlerFunc) (*Handlers, workers.CanaryStatus) {
+	t.Helper()
+	h := startHub(t, fmt.Sprintf(`
+models:
+  s-v1:
+    name: "s"
+    version: 1
+    aliases: [stable]
+    runtime: "remote"
+    endpoints: ["%s"]
+  s-v2:
+    name: "s"
+    version: 2
+    runtime: "remote"
+    endpoints: ["%s"]
+    retries: 0
+    canary: {steps: [100], step_duration: 1ms, min_requests: 2}
+`, startEndpoint(t, echo), startEndpoint(t, candidate)))
+	if _, err := h.manager.StartCanary("s@stable", "s@2"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		predict(h, `{"instances":[1],"parameters":{"model":"s@stable"}}`, nil)
+		status, _ := h.manager.Canary("s@stable")
+		if status.State != workers.CanaryRunning {
+			return h, status
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("canary did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCanaryPromoted(t *testing.T) {
+	h, status := runCanary(t, echo)
+	if status.State != workers.CanaryPromoted {
+		t.Fatalf("canary %s: %s, want %s", status.State, status.Reason, workers.CanaryPromoted)
+	}
+	if model := predict(h, `{"instances":[1],"parameters":{"model":"s@stable"}}`, nil).Header().Get(modelHeader); model != "s@2" {
+		t.Errorf("alias served by %q after the promotion, want s@2", model)
+	}
+}
+
+func TestCanaryRolledBack(t *testing.T) {
+	var calls atomic.Int32
+	h, status := runCanary(t, failing(&calls))
+	if status.State != workers.CanaryRolledBack || !strings.Contains(status.Reason, "error rate") {
+		t.Fatalf("canary %s: %q, want %s because of the error rate", status.State, status.Reason, workers.CanaryRolledBack)
+	}
+	if model := predict(h, `{"instances":[1],"parameters":{"model":"s@stable"}}`, nil).Header().Get(modelHeader); model != "s@1" {
+		t.Errorf("alias served by %q after the rollback, want s@1", model)
+	}
+	if _, err := h.manager.AbortCanary("s@stable"); err == nil {
+		t.Error("finished canary aborted")
+	}
+}
+
+func TestCanaryRequiresConfiguration(t *testing.T) {
+	h := startHub(t, fmt.Sprintf(`
+models:
+  s-v1:
+    name: "s"
+    version: 1
+    aliases: [stable]
+    runtime: "remote"
+    endpoints: ["%s"]
+  s-v2:
+    name: "s"
+    version: 2
+    runtime: "remote"
+    endpoints: ["%s"]
+`, startEndpoint(t, echo), startEndpoint(t, echo)))
+	if _, err := h.manager.StartCanary("s@stable", "s@2"); err == nil {
+		t.Fatal("canary started for a version without canary configuration")
+	}
+	if model := predict(h, `{"instances":[1],"parameters":{"model":"s@stable"}}`, nil).Header().Get(modelHeader); model != "s@1" {
+		t.Errorf("alias served by %q, want s@1", model)
+	}
+}
+
+// decodedPredictHandler is the predict path before bodies were forwarded raw:
+// the request is decoded and marshalled again for the worker, and the worker
+// response is decoded and encoded again for the client.
+func (h *Handlers) decodedPredictHandler(c *gin.Context) {
+	var req models.PredictRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decode request body"})
+		return
+	}
+	model, _ := req.Params["model"].(string)
+	priority, _ := req.Params["priority"].(float64)
+	body, err := json.Marshal(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	worker, err := h.manager.GetAvailableWorker(c.Request.Context(), models.ModelName(model), workers.RequestOptions{Priority: int(priority)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	prediction, err := worker.Predict(c.Request.Context(), body)
+	if err != nil {
+		h.manager.ReleaseWorker(worker.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respBody, err := io.ReadAll(prediction.Body)
+	prediction.Body.Close()
+	h.manager.ReleaseWorker(worker.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var response interface{}
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func BenchmarkPredictHandler(b *testing.B) {
+	h := startHub(b, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+`, startEndpoint(b, echo)))
+	for _, size := range []int{1 << 20, 8 << 20} {
+		body := fixtures.PredictPayload("m", size)
+		for _, handler := range []struct {
+			name   string
+			handle gin.HandlerFunc
+		}{
+			{"decoded", h.decodedPredictHandler},
+			{"passthrough", h.PredictHandler},
+		} {
+			router := gin.New()
+			router.POST("/predict", handler.handle)
+			b.Run(fmt.Sprintf("%s/%dMB", handler.name, size>>20), func(b *testing.B) {
+				b.SetBytes(int64(2 * len(body)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					recorder := httptest.NewRecorder()
+					router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/predict", bytes.NewReader(body)))
+					if recorder.Code != http.StatusOK {
+						b.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+					}
+				}
+			})
+		}
+	}
+}
@@ -3,17 +3,29 @@ package api
 import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"model-hub/config"
 	"model-hub/helper"
 	"model-hub/workers"
 )
 
-func NewAPIServer(manager *workers.WorkerManager, logger *zap.Logger) {
-	handlers := NewHandlers(manager, logger)
+func NewAPIServer(manager *workers.WorkerManager, cfg *config.Config, logger *zap.Logger) {
+	handlers := NewHandlers(manager, cfg, logger)
 	r := gin.Default()
 
 	r.POST("/predict", handlers.PredictHandler)
 	r.GET("/ping", handlers.PingHandler)
 	r.POST("/model-ready", handlers.ModelReady)
+	r.POST("/workers/register", handlers.RegisterWorker)
+	r.GET("/admin/workers", handlers.WorkersStatus)
+	r.GET("/admin/tenants", handlers.TenantsStatus)
+	r.GET("/admin/models", handlers.ModelsStatus)
+	r.POST("/admin/models/:name/rollout", handlers.StartRollout)
+	r.GET("/admin/models/:name/rollout", handlers.RolloutStatus)
+	r.GET("/admin/aliases", handlers.Aliases)
+	r.PUT("/admin/aliases/:alias", handlers.SetAlias)
+	r.POST("/admin/aliases/:alias/canary", handlers.StartCanary)
+	r.GET("/admin/aliases/:alias/canary", handlers.CanaryStatus)
+	r.DELETE("/admin/aliases/:alias/canary", handlers.AbortCanary)
 
 	addr := "0.0.0.0:" + helper.GetEnv("SERVER_PORT", "7766")
 	logger.Info("Starting server...")
@@ -1,21 +1,400 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"model-hub/models"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	RuntimePython   = "python"
+	RuntimeCommand  = "command"
+	RuntimeFunction = "function"
+	RuntimeRemote   = "remote"
+
+	TransportTCP  = "tcp"
+	TransportUnix = "unix"
+
+	SchedulerPriority = "priority"
+	SchedulerFIFO     = "fifo"
+	SchedulerEDF      = "edf"
+	SchedulerFair     = "fair"
+
+	OnExceedClamp  = "clamp"
+	OnExceedReject = "reject"
+
+	// VersionSeparator separates a model name from a version or an alias, as in
+	// sentiment@3 or sentiment@stable.
+	VersionSeparator = "@"
+)
+
 type Model struct {
 	Name    models.ModelName `yaml:"name"`
 	Path    string           `yaml:"path"`
 	Handler string           `yaml:"handler"`
 	Workers int              `yaml:"workers"`
+	// Version makes the model one version of Name, served as name@version.
+	// Aliases name@alias point to it until they are retargeted through the
+	// admin API. The name alone points to the latest version.
+	Version int      `yaml:"version"`
+	Aliases []string `yaml:"aliases"`
+	// Split makes the model a weighted traffic split between other models
+	// instead of serving requests with its own workers.
+	Split []SplitVariant `yaml:"split"`
+	// Pipeline makes the model a chain of other models instead: every step is
+	// sent instances and parameters mapped from the request and the responses of
+	// the earlier steps, and the response of the last step is returned.
+	Pipeline []PipelineStep `yaml:"pipeline"`
+	// Runtime selects what backs the workers: "python" (default) runs worker.py,
+	// "command" runs Command with placeholders substituted, "function" calls a Go
+	// function registered under Function and "remote" forwards to Endpoints.
+	Runtime   string   `yaml:"runtime"`
+	Command   []string `yaml:"command"`
+	Function  string   `yaml:"function"`
+	Endpoints []string `yaml:"endpoints"`
+	// Transport is how the hub talks to local worker processes: "tcp" (default) or
+	// "unix" for a per-worker socket in WORKERS_RUNTIME_DIR.
+	Transport string `yaml:"transport"`
+	// Scheduler orders queued requests: "priority" (default), "fifo", "edf"
+	// (earliest deadline first) or "fair" (weighted fair sharing between tenants).
+	Scheduler string            `yaml:"scheduler"`
+	Aging     *Aging            `yaml:"aging"`
+	Tenants   map[string]Tenant `yaml:"tenants"`
+	Reserve   *Reserve          `yaml:"reserve"`
+	// DefaultPriority is the priority of requests that name none, 1 if unset.
+	DefaultPriority PriorityValue `yaml:"default_priority"`
+	Hedge           *Hedge        `yaml:"hedge"`
+	// Retries is how often a request that could not reach its worker is retried
+	// on another worker. Defaults to 2.
+	Retries        *int            `yaml:"retries"`
+	CircuitBreaker *CircuitBreaker `yaml:"circuit_breaker"`
+	// Fallback lists the models that serve a request in turn when this model's
+	// circuit breaker is open, the request waited longer than FallbackAfter for
+	// a worker or the prediction failed.
+	Fallback      []models.ModelName `yaml:"fallback"`
+	FallbackAfter time.Duration      `yaml:"fallback_after"`
+	Shadow        *Shadow            `yaml:"shadow"`
+	// Warmup requests are sent to every worker after its model loaded and before
+	// it takes requests, so the first requests do not hit a cold worker.
+	Warmup *Warmup `yaml:"warmup"`
+	// Canary configures how traffic is moved to this model when an alias is
+	// switched to it progressively through the admin API. Only models with a
+	// canary configuration can be canaries.
+	Canary *Canary `yaml:"canary"`
+	// Timeouts of the HTTP connection to the workers. Responses are awaited
+	// without a limit unless ResponseHeaderTimeout is set.
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// MaxRegistered is the number of remote workers allowed to join through POST /workers/register.
+	MaxRegistered       int           `yaml:"max_registered"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	HeartbeatTimeout    time.Duration `yaml:"heartbeat_timeout"`
+}
+
+// SplitVariant is a model that receives Weight out of the total weight of a split.
+type SplitVariant struct {
+	Model  models.ModelName `yaml:"model"`
+	Weight int              `yaml:"weight"`
+}
+
+// PipelineStep sends a request to Model. Strings in Instances and Parameters that
+// start with "$" refer to a value of the request ("$request.instances"), of the
+// previous step ("$previous.predictions") or of an earlier step by name, e.g.
+// "$detect.predictions.0" or "$detect.predictions.*.language" for the language of
+// every prediction. "$$" starts a string that begins with "$".
+type PipelineStep struct {
+	// Name is how later steps refer to the step, the model name by default.
+	Name  string           `yaml:"name"`
+	Model models.ModelName `yaml:"model"`
+	// Instances default to the request instances for the first step and the
+	// predictions of the previous step for the others.
+	Instances interface{} `yaml:"instances"`
+	// Parameters default to the request parameters.
+	Parameters map[string]interface{} `yaml:"parameters"`
+}
+
+const (
+	// ReferencePrefix starts a reference to a value in a pipeline step mapping.
+	ReferencePrefix = "$"
+	// RequestStep and PreviousStep are the pipeline step names that refer to the
+	// request and to the previous step.
+	RequestStep  = "request"
+	PreviousStep = "previous"
+)
+
+// Aging raises the effective priority of a queued request by Step for every
+// Interval it waits, so low priority requests are not starved.
+type Aging struct {
+	Interval time.Duration `yaml:"interval"`
+	Step     float64       `yaml:"step"`
+}
+
+// Reserve keeps the last Workers free workers of a model for requests with at least MinPriority.
+type Reserve struct {
+	Workers     int `yaml:"workers"`
+	MinPriority int `yaml:"min_priority"`
+}
+
+// Hedge sends a request to a second idle worker when no response arrived within
+// the Percentile of recent response times of the model, but not before MinDelay.
+// The first successful response is used and the other call is cancelled.
+type Hedge struct {
+	Percentile float64       `yaml:"percentile"`
+	MinDelay   time.Duration `yaml:"min_delay"`
+}
+
+// CircuitBreaker stops sending requests to a model once ErrorRate of its last
+// Window requests failed. After OpenFor, Probes trial requests are let through
+// and the breaker closes again if all of them succeed.
+type CircuitBreaker struct {
+	ErrorRate float64       `yaml:"error_rate"`
+	Window    int           `yaml:"window"`
+	OpenFor   time.Duration `yaml:"open_for"`
+	Probes    int           `yaml:"probes"`
+}
+
+// Shadow sends a copy of a Sample fraction of the requests of a model to the
+// Model under test. Shadow responses are dropped, or written to the Record
+// JSONL file together with the primary response.
+type Shadow struct {
+	Model  models.ModelName `yaml:"model"`
+	Sample float64          `yaml:"sample"`
+	Record string           `yaml:"record"`
+}
+
+// Warmup lists request bodies inline as Samples, or one JSON body per line in File.
+type Warmup struct {
+	Samples []interface{} `yaml:"samples"`
+	File    string        `yaml:"file"`
+	// Requests are the JSON request bodies of Samples and File.
+	Requests []json.RawMessage `yaml:"-"`
+}
+
+// Canary sends Steps percentages of the traffic of an alias to a new model, each
+// for at least StepDuration and MinRequests requests. The new model is rolled
+// back as soon as its error rate exceeds the one of the model the alias pointed
+// to by more than MaxErrorRateIncrease, or its p95 response time exceeds the
+// baseline's by more than the MaxLatencyIncrease fraction.
+type Canary struct {
+	Steps                []int         `yaml:"steps"`
+	StepDuration         time.Duration `yaml:"step_duration"`
+	MinRequests          int           `yaml:"min_requests"`
+	MaxErrorRateIncrease float64       `yaml:"max_error_rate_increase"`
+	MaxLatencyIncrease   float64       `yaml:"max_latency_increase"`
+}
+
+// DefaultTenant is the tenant of requests that name none, AnyTenant configures
+// tenants without their own entry.
+const (
+	DefaultTenant = "default"
+	AnyTenant     = "*"
+)
+
+// Tenant configures how a tenant shares the workers of a model. MaxConcurrent
+// counts queued and running requests, MaxQueued only queued ones. Requests over
+// either limit are rejected, zero limits mean unlimited.
+type Tenant struct {
+	Weight        float64 `yaml:"weight"`
+	MaxConcurrent int     `yaml:"max_concurrent"`
+	MaxQueued     int     `yaml:"max_queued"`
+}
+
+// APIKey is a client key accepted by /predict. Requests made with it belong to Tenant.
+type APIKey struct {
+	Key    string `yaml:"key"`
+	Tenant string `yaml:"tenant"`
+	// MaxPriority caps the priority of requests made with the key. Requests above
+	// it are lowered to it ("clamp", default) or refused ("reject") per OnExceed.
+	MaxPriority PriorityValue `yaml:"max_priority"`
+	OnExceed    string        `yaml:"on_exceed"`
+}
+
+// PriorityValue is a priority given either as a number or as the name of a priority class.
+type PriorityValue string
+
+// PriorityClasses maps priority class names such as "realtime" or "batch" to priorities.
+type PriorityClasses map[string]int
+
+// Resolve returns the priority of a number or a class name.
+func (classes PriorityClasses) Resolve(value PriorityValue) (int, error) {
+	if priority, ok := classes[string(value)]; ok {
+		return priority, nil
+	}
+	priority, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("unknown priority class %q", value)
+	}
+	return priority, nil
 }
 
 type Config struct {
-	Models map[string]Model `yaml:"models"`
+	Models          map[string]Model `yaml:"models"`
+	APIKeys         []APIKey         `yaml:"api_keys"`
+	PriorityClasses PriorityClasses  `yaml:"priority_classes"`
+	// Aliases are the initial model aliases, collected from the models.
+	Aliases map[models.ModelName]models.ModelName `yaml:"-"`
+}
+
+// BaseName returns the model name without version or alias.
+func BaseName(name models.ModelName) models.ModelName {
+	base, _, _ := strings.Cut(string(name), VersionSeparator)
+	return models.ModelName(base)
+}
+
+// validatePipeline sets the defaults of the steps and checks that their mappings
+// only refer to the request and to earlier steps.
+func validatePipeline(steps []PipelineStep) error {
+	names := map[string]bool{RequestStep: true}
+	for i := range steps {
+		step := &steps[i]
+		if step.Name == "" {
+			step.Name = string(step.Model)
+		}
+		if step.Name == RequestStep || step.Name == PreviousStep || strings.Contains(step.Name, ".") {
+			return fmt.Errorf("invalid pipeline step name %s", step.Name)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("pipeline step %s is defined more than once, name the steps", step.Name)
+		}
+		if step.Instances == nil {
+			step.Instances = ReferencePrefix + PreviousStep + ".predictions"
+			if i == 0 {
+				step.Instances = ReferencePrefix + RequestStep + ".instances"
+			}
+		}
+		instances, err := jsonValue(step.Instances)
+		if err != nil {
+			return fmt.Errorf("pipeline step %s: instances: %v", step.Name, err)
+		}
+		step.Instances = instances
+		for name, value := range step.Parameters {
+			if step.Parameters[name], err = jsonValue(value); err != nil {
+				return fmt.Errorf("pipeline step %s: parameter %s: %v", step.Name, name, err)
+			}
+		}
+		if i > 0 {
+			names[PreviousStep] = true
+		}
+		if err := checkReferences(step.Instances, names); err != nil {
+			return fmt.Errorf("pipeline step %s: %v", step.Name, err)
+		}
+		if err := checkReferences(step.Parameters, names); err != nil {
+			return fmt.Errorf("pipeline step %s: %v", step.Name, err)
+		}
+		names[step.Name] = true
+	}
+	return nil
+}
+
+// checkReferences checks that the references in a mapping name known steps.
+func checkReferences(value interface{}, names map[string]bool) error {
+	switch value := value.(type) {
+	case string:
+		if !strings.HasPrefix(value, ReferencePrefix) || strings.HasPrefix(value, ReferencePrefix+ReferencePrefix) {
+			return nil
+		}
+		step, _, _ := strings.Cut(strings.TrimPrefix(value, ReferencePrefix), ".")
+		if !names[step] {
+			return fmt.Errorf("%s refers to no earlier step", value)
+		}
+	case map[string]interface{}:
+		for _, item := range value {
+			if err := checkReferences(item, names); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if err := checkReferences(item, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load collects the request bodies of the inline samples and the file.
+func (w *Warmup) load() error {
+	w.Requests = nil
+	for i, sample := range w.Samples {
+		value, err := jsonValue(sample)
+		if err != nil {
+			return fmt.Errorf("sample %d: %v", i+1, err)
+		}
+		body, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("sample %d: %v", i+1, err)
+		}
+		w.Requests = append(w.Requests, body)
+	}
+	if w.File != "" {
+		data, err := os.ReadFile(w.File)
+		if err != nil {
+			return err
+		}
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return fmt.Errorf("line %d of %s is not valid JSON", i+1, w.File)
+			}
+			w.Requests = append(w.Requests, json.RawMessage(line))
+		}
+	}
+	if len(w.Requests) == 0 {
+		return fmt.Errorf("samples or a file with requests is required")
+	}
+	return nil
+}
+
+// jsonValue converts a value decoded from YAML, whose maps may have keys of any
+// type, into one that can be encoded as JSON.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = converted
+		}
+		return object, nil
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, item := range value {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = converted
+		}
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+// TenantConfig returns the settings of the tenant for the model.
+func (m Model) TenantConfig(tenant string) Tenant {
+	if config, ok := m.Tenants[tenant]; ok {
+		return config
+	}
+	return m.Tenants[AnyTenant]
 }
 
 func Load(filename string) (*Config, error) {
@@ -30,5 +409,299 @@ func Load(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
+
+func (cfg *Config) validate() error {
+	for name := range cfg.PriorityClasses {
+		if _, err := strconv.Atoi(name); err == nil {
+			return fmt.Errorf("priority_classes: class name %s must not be a number", name)
+		}
+	}
+	modelNames := make(map[models.ModelName]bool)
+	splits := make(map[models.ModelName]bool)
+	pipelines := make(map[models.ModelName]bool)
+	for key, model := range cfg.Models {
+		if model.Name == "" || strings.Contains(string(model.Name), VersionSeparator) {
+			return fmt.Errorf("model %s: name must be set and must not contain %q", key, VersionSeparator)
+		}
+		if model.Version < 0 {
+			return fmt.Errorf("model %s: version must not be negative", model.Name)
+		}
+		if model.Version > 0 {
+			model.Name = models.ModelName(fmt.Sprintf("%s%s%d", model.Name, VersionSeparator, model.Version))
+			cfg.Models[key] = model
+		}
+		if modelNames[model.Name] {
+			return fmt.Errorf("model %s: defined more than once", model.Name)
+		}
+		modelNames[model.Name] = true
+		if len(model.Split) > 0 {
+			splits[model.Name] = true
+		}
+		if len(model.Pipeline) > 0 {
+			if len(model.Split) > 0 {
+				return fmt.Errorf("model %s: a model can not be both a split and a pipeline", model.Name)
+			}
+			pipelines[model.Name] = true
+		}
+	}
+	if err := cfg.collectAliases(modelNames); err != nil {
+		return err
+	}
+	// known reports whether name is a model or alias that is served by workers
+	known := func(name models.ModelName) bool {
+		if target, ok := cfg.Aliases[name]; ok {
+			name = target
+		}
+		return modelNames[name] && !splits[name] && !pipelines[name]
+	}
+	for key, model := range cfg.Models {
+		if model.DefaultPriority == "" {
+			model.DefaultPriority = "1"
+		}
+		if _, err := cfg.PriorityClasses.Resolve(model.DefaultPriority); err != nil {
+			return fmt.Errorf("model %s: default_priority: %v", model.Name, err)
+		}
+		if len(model.Split) > 0 {
+			if model.Workers > 0 || model.Runtime != "" || len(model.Endpoints) > 0 || model.MaxRegistered > 0 {
+				return fmt.Errorf("model %s: a split has no workers of its own", model.Name)
+			}
+			for _, variant := range model.Split {
+				if !known(variant.Model) {
+					return fmt.Errorf("model %s: unknown split model %s", model.Name, variant.Model)
+				}
+				if variant.Weight <= 0 {
+					return fmt.Errorf("model %s: split model %s requires a positive weight", model.Name, variant.Model)
+				}
+			}
+			cfg.Models[key] = model
+			continue
+		}
+		if len(model.Pipeline) > 0 {
+			if model.Workers > 0 || model.Runtime != "" || len(model.Endpoints) > 0 || model.MaxRegistered > 0 {
+				return fmt.Errorf("model %s: a pipeline has no workers of its own", model.Name)
+			}
+			// steps may name splits, but no pipelines
+			for i := range model.Pipeline {
+				step := &model.Pipeline[i]
+				name := step.Model
+				if target, ok := cfg.Aliases[name]; ok {
+					name = target
+				}
+				if !modelNames[name] || pipelines[name] {
+					return fmt.Errorf("model %s: unknown pipeline model %s", model.Name, step.Model)
+				}
+			}
+			if err := validatePipeline(model.Pipeline); err != nil {
+				return fmt.Errorf("model %s: %v", model.Name, err)
+			}
+			cfg.Models[key] = model
+			continue
+		}
+		switch model.Runtime {
+		case "":
+			model.Runtime = RuntimePython
+		case RuntimePython:
+		case RuntimeCommand:
+			if len(model.Command) == 0 {
+				return fmt.Errorf("model %s: runtime %q requires a command", model.Name, model.Runtime)
+			}
+		case RuntimeFunction:
+			if model.Function == "" {
+				return fmt.Errorf("model %s: runtime %q requires a function", model.Name, model.Runtime)
+			}
+		case RuntimeRemote:
+			if len(model.Endpoints) == 0 && model.MaxRegistered == 0 {
+				return fmt.Errorf("model %s: runtime %q requires endpoints or max_registered", model.Name, model.Runtime)
+			}
+			// every static endpoint is served by its own worker
+			model.Workers = len(model.Endpoints)
+			if model.HealthCheckInterval == 0 {
+				model.HealthCheckInterval = 10 * time.Second
+			}
+			if model.HeartbeatTimeout == 0 {
+				model.HeartbeatTimeout = 30 * time.Second
+			}
+		default:
+			return fmt.Errorf("model %s: unknown runtime %q", model.Name, model.Runtime)
+		}
+		switch model.Scheduler {
+		case "":
+			model.Scheduler = SchedulerPriority
+			if len(model.Tenants) > 0 {
+				model.Scheduler = SchedulerFair
+			}
+		case SchedulerPriority, SchedulerFIFO, SchedulerEDF, SchedulerFair:
+		default:
+			return fmt.Errorf("model %s: unknown scheduler %q", model.Name, model.Scheduler)
+		}
+		if model.Aging != nil {
+			if model.Scheduler != SchedulerPriority && model.Scheduler != SchedulerFair {
+				return fmt.Errorf("model %s: aging is not supported by the %q scheduler", model.Name, model.Scheduler)
+			}
+			if model.Aging.Interval <= 0 || model.Aging.Step <= 0 {
+				return fmt.Errorf("model %s: aging requires a positive interval and step", model.Name)
+			}
+		}
+		if model.Reserve != nil {
+			if model.Reserve.Workers <= 0 {
+				return fmt.Errorf("model %s: reserve requires a positive number of workers", model.Name)
+			}
+			if model.Runtime != RuntimeRemote && model.Reserve.Workers >= model.Workers {
+				return fmt.Errorf("model %s: reserve must leave workers for other requests", model.Name)
+			}
+		}
+		if model.Hedge != nil {
+			if model.Hedge.Percentile == 0 {
+				model.Hedge.Percentile = 95
+			}
+			if model.Hedge.Percentile < 0 || model.Hedge.Percentile >= 100 {
+				return fmt.Errorf("model %s: hedge percentile must be between 0 and 100", model.Name)
+			}
+		}
+		if model.Retries == nil {
+			retries := 2
+			model.Retries = &retries
+		}
+		if *model.Retries < 0 {
+			return fmt.Errorf("model %s: retries must not be negative", model.Name)
+		}
+		if breaker := model.CircuitBreaker; breaker != nil {
+			if breaker.ErrorRate == 0 {
+				breaker.ErrorRate = 0.5
+			}
+			if breaker.Window == 0 {
+				breaker.Window = 20
+			}
+			if breaker.OpenFor == 0 {
+				breaker.OpenFor = 30 * time.Second
+			}
+			if breaker.Probes == 0 {
+				breaker.Probes = 1
+			}
+			if breaker.ErrorRate < 0 || breaker.ErrorRate > 1 || breaker.Window < 0 || breaker.OpenFor < 0 || breaker.Probes < 0 {
+				return fmt.Errorf("model %s: circuit_breaker requires an error_rate between 0 and 1 and positive window, open_for and probes", model.Name)
+			}
+		}
+		for _, fallback := range model.Fallback {
+			if fallback == model.Name || !known(fallback) {
+				return fmt.Errorf("model %s: unknown fallback model %s", model.Name, fallback)
+			}
+		}
+		if shadow := model.Shadow; shadow != nil {
+			if shadow.Model == model.Name || !known(shadow.Model) {
+				return fmt.Errorf("model %s: unknown shadow model %s", model.Name, shadow.Model)
+			}
+			if shadow.Sample == 0 {
+				shadow.Sample = 1
+			}
+			if shadow.Sample < 0 || shadow.Sample > 1 {
+				return fmt.Errorf("model %s: shadow sample must be between 0 and 1", model.Name)
+			}
+		}
+		if model.Warmup != nil {
+			if err := model.Warmup.load(); err != nil {
+				return fmt.Errorf("model %s: warmup: %v", model.Name, err)
+			}
+		}
+		if canary := model.Canary; canary != nil {
+			if len(canary.Steps) == 0 {
+				canary.Steps = []int{5, 25, 100}
+			}
+			for i, step := range canary.Steps {
+				if step <= 0 || step > 100 || (i > 0 && step <= canary.Steps[i-1]) {
+					return fmt.Errorf("model %s: canary steps must be increasing percentages", model.Name)
+				}
+			}
+			if canary.Steps[len(canary.Steps)-1] != 100 {
+				return fmt.Errorf("model %s: the last canary step must be 100", model.Name)
+			}
+			if canary.StepDuration == 0 {
+				canary.StepDuration = 5 * time.Minute
+			}
+			if canary.MinRequests == 0 {
+				canary.MinRequests = 20
+			}
+			if canary.MaxErrorRateIncrease == 0 {
+				canary.MaxErrorRateIncrease = 0.05
+			}
+			if canary.MaxLatencyIncrease == 0 {
+				canary.MaxLatencyIncrease = 0.2
+			}
+			if canary.StepDuration < 0 || canary.MinRequests < 0 || canary.MaxErrorRateIncrease < 0 || canary.MaxErrorRateIncrease > 1 || canary.MaxLatencyIncrease < 0 {
+				return fmt.Errorf("model %s: canary requires a positive step_duration and min_requests, a max_error_rate_increase between 0 and 1 and a positive max_latency_increase", model.Name)
+			}
+		}
+		if model.FallbackAfter < 0 {
+			return fmt.Errorf("model %s: fallback_after must not be negative", model.Name)
+		}
+		if model.DialTimeout == 0 {
+			model.DialTimeout = 5 * time.Second
+		}
+		if model.ResponseHeaderTimeout < 0 {
+			return fmt.Errorf("model %s: response_header_timeout must not be negative", model.Name)
+		}
+		switch model.Transport {
+		case "":
+			model.Transport = TransportTCP
+		case TransportTCP:
+		case TransportUnix:
+			if model.Runtime != RuntimePython && model.Runtime != RuntimeCommand {
+				return fmt.Errorf("model %s: transport %q is only supported by local runtimes", model.Name, model.Transport)
+			}
+		default:
+			return fmt.Errorf("model %s: unknown transport %q", model.Name, model.Transport)
+		}
+		cfg.Models[key] = model
+	}
+	for i, apiKey := range cfg.APIKeys {
+		if apiKey.Key == "" {
+			return fmt.Errorf("api_keys: empty key for tenant %s", apiKey.Tenant)
+		}
+		if apiKey.MaxPriority != "" {
+			if _, err := cfg.PriorityClasses.Resolve(apiKey.MaxPriority); err != nil {
+				return fmt.Errorf("api_keys: max_priority of tenant %s: %v", apiKey.Tenant, err)
+			}
+		}
+		switch apiKey.OnExceed {
+		case "":
+			cfg.APIKeys[i].OnExceed = OnExceedClamp
+		case OnExceedClamp, OnExceedReject:
+		default:
+			return fmt.Errorf("api_keys: unknown on_exceed %q for tenant %s", apiKey.OnExceed, apiKey.Tenant)
+		}
+	}
+	return nil
+}
+
+// collectAliases sets the aliases of the models, and points the names of
+// versioned models to their latest version.
+func (cfg *Config) collectAliases(modelNames map[models.ModelName]bool) error {
+	cfg.Aliases = make(map[models.ModelName]models.ModelName)
+	latest := make(map[models.ModelName]Model)
+	for _, model := range cfg.Models {
+		base := BaseName(model.Name)
+		for _, label := range model.Aliases {
+			if _, err := strconv.Atoi(label); err == nil || label == "" || strings.Contains(label, VersionSeparator) {
+				return fmt.Errorf("model %s: invalid alias %q", model.Name, label)
+			}
+			alias := base + VersionSeparator + models.ModelName(label)
+			if _, ok := cfg.Aliases[alias]; ok {
+				return fmt.Errorf("model %s: alias %s is used more than once", model.Name, alias)
+			}
+			cfg.Aliases[alias] = model.Name
+		}
+		if model.Version > 0 && !modelNames[base] && model.Version > latest[base].Version {
+			latest[base] = model
+		}
+	}
+	for base, model := range latest {
+		cfg.Aliases[base] = model.Name
+	}
+	return nil
+}
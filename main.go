@@ -24,7 +24,7 @@ func main() {
 	logger.Info("Starting workers")
 	go workerManager.Initialize()
 
-	api.NewAPIServer(workerManager, logger)
+	api.NewAPIServer(workerManager, cfg, logger)
 }
 
 func createLogger() *zap.Logger {
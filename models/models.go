@@ -23,3 +23,16 @@ type PredictRequest struct {
 type PredictResponse struct {
 	Predictions []interface{} `json:"predictions"`
 }
+
+// PredictEnvelope holds the request fields the hub needs for routing. The
+// request body itself is forwarded to the worker untouched.
+type PredictEnvelope struct {
+	Params struct {
+		Model      interface{} `json:"model"`
+		Priority   interface{} `json:"priority"`
+		Metadata   interface{} `json:"metadata"`
+		Tenant     interface{} `json:"tenant"`
+		Deadline   interface{} `json:"deadline"`
+		RoutingKey interface{} `json:"routing_key"`
+	} `json:"parameters"`
+}
@@ -0,0 +1,21 @@
+// Package fixtures builds request bodies shared by the tests and benchmarks of the hub.
+package fixtures
+
+import "strings"
+
+// PredictPayload returns a predict request body for model of about size bytes,
+// with rows of feature vectors as instances.
+func PredictPayload(model string, size int) []byte {
+	row := "[" + strings.TrimSuffix(strings.Repeat("0.123456789,", 64), ",") + "]"
+	rows := size / (len(row) + 1)
+	var body strings.Builder
+	body.WriteString(`{"instances":[`)
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(row)
+	}
+	body.WriteString(`],"parameters":{"model":"` + model + `","priority":1}}`)
+	return []byte(body.String())
+}
@@ -3,52 +3,113 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// result of a single request
+type result struct {
+	priority int
+	latency  time.Duration
+	order    int // completion position among all requests
+	err      error
+}
+
 func main() {
+	url := flag.String("url", "http://127.0.0.1:7766/predict", "predict endpoint")
+	model := flag.String("model", "model2", "model to send requests to")
+	requests := flag.Int("requests", 100, "requests per priority")
+	priorities := flag.String("priorities", "100,200,300", "comma separated priorities")
+	flag.Parse()
+
+	var prioritiesList []int
+	for _, p := range strings.Split(*priorities, ",") {
+		priority, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			fmt.Println("Invalid priority:", p)
+			return
+		}
+		prioritiesList = append(prioritiesList, priority)
+	}
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1024}}
+	results := make(chan result, *requests*len(prioritiesList))
 	wg := &sync.WaitGroup{}
+	var completed int
+	var completedMu sync.Mutex
 
-	sendRequest(wg, 100)
-	sendRequest(wg, 200)
-	sendRequest(wg, 300)
+	start := time.Now()
+	for _, priority := range prioritiesList {
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"parameters": map[string]interface{}{
+				"model":    *model,
+				"priority": priority,
+				"metadata": "Load test",
+			},
+		})
+		// Launching goroutines for concurrent request sending
+		for i := 0; i < *requests; i++ {
+			wg.Add(1)
+			go func(priority int) {
+				defer wg.Done()
+				sent := time.Now()
+				err := sendPostRequest(client, *url, requestBody)
+				completedMu.Lock()
+				completed++
+				order := completed
+				completedMu.Unlock()
+				results <- result{priority: priority, latency: time.Since(sent), order: order, err: err}
+			}(priority)
+		}
+	}
 	wg.Wait()
-	fmt.Println("All requests sent.")
-}
+	close(results)
+	total := time.Since(start)
+
+	byPriority := make(map[int][]result)
+	for r := range results {
+		byPriority[r.priority] = append(byPriority[r.priority], r)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(prioritiesList)))
 
-func sendRequest(wg *sync.WaitGroup, priority int) {
-	url := "http://127.0.0.1:7766/predict"
-	contentType := "application/json"
-	requestBody, _ := json.Marshal(map[string]interface{}{
-		"parameters": map[string]interface{}{
-			"model":    "model2",
-			"priority": priority,
-			"metadata": "From server 1",
-		},
-	})
-	// Launching 100 goroutines for concurrent request sending
-	for i := 0; i < 100; i++ {
-		go sendPostRequest(wg, url, contentType, requestBody, strconv.Itoa(priority)+"--"+strconv.Itoa(i))
+	count := *requests * len(prioritiesList)
+	fmt.Printf("%d requests in %s (%.1f req/s)\n", count, total.Round(time.Millisecond), float64(count)/total.Seconds())
+	fmt.Println("priority  errors  avg latency  p95 latency  avg completion position")
+	for _, priority := range prioritiesList {
+		list := byPriority[priority]
+		sort.Slice(list, func(i, j int) bool { return list[i].latency < list[j].latency })
+		var errors, orderSum int
+		var latencySum time.Duration
+		for _, r := range list {
+			if r.err != nil {
+				errors++
+			}
+			latencySum += r.latency
+			orderSum += r.order
+		}
+		p95 := list[len(list)*95/100].latency
+		fmt.Printf("%8d  %6d  %11s  %11s  %23.1f\n", priority, errors,
+			(latencySum / time.Duration(len(list))).Round(time.Millisecond), p95.Round(time.Millisecond),
+			float64(orderSum)/float64(len(list)))
 	}
 }
 
-func sendPostRequest(wg *sync.WaitGroup, url string, contentType string, body []byte, meta string) {
-	wg.Add(1)
-	defer wg.Done()
-	fmt.Println("Sending request")
-	resp, err := http.Post(url, contentType, bytes.NewBuffer(body))
-	fmt.Println("Send " + meta)
+func sendPostRequest(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		fmt.Println("Error sending request:", err)
-		fmt.Println("Retry")
-		sendPostRequest(wg, url, contentType, body, meta)
-		return
+		return err
 	}
 	defer resp.Body.Close()
-
-	fmt.Println("Request sent, status:", resp.Status)
-	return
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
 }
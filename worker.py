@@ -8,6 +8,7 @@ import logging
 import time
 
 import requests
+import socketserver
 from http.server import BaseHTTPRequestHandler, HTTPServer
 
 parser = argparse.ArgumentParser()
@@ -15,20 +16,47 @@ parser.add_argument('worker_id', type=str)
 parser.add_argument('path', type=str)
 parser.add_argument('port', type=int)
 parser.add_argument('handler_path', type=str)
+parser.add_argument('--socket', type=str, default=None, help='serve on this unix socket instead of the TCP port')
 args = parser.parse_args()
 
 logging.basicConfig(format=f'[%(levelname)s][Python worker][{args.worker_id}] %(message)s', level=logging.INFO)
 
 
+class UnixHTTPServer(socketserver.UnixStreamServer):
+    def server_bind(self):
+        if os.path.exists(self.server_address):
+            os.unlink(self.server_address)
+        super().server_bind()
+        # only the hub user may talk to the worker
+        os.chmod(self.server_address, 0o600)
+
+
 class RequestHandler(BaseHTTPRequestHandler):
-    def send_error(self, code, message=None):
+    # keep the connection to the hub open between requests
+    protocol_version = 'HTTP/1.1'
+
+    def address_string(self):
+        # unix socket clients have no address
+        return self.client_address[0] if self.client_address else 'unix'
+
+    def send_body(self, code, body):
         self.send_response(code)
         self.send_header('Content-Type', 'application/json')
+        self.send_header('Content-Length', str(len(body)))
         self.end_headers()
+        self.wfile.write(body)
+
+    def send_error(self, code, message=None, explain=None):
         error_message = {
             'error': message if message else f"Error code: {code}"
         }
-        self.wfile.write(json.dumps(error_message).encode('utf-8'))
+        self.send_body(code, json.dumps(error_message).encode('utf-8'))
+
+    def do_GET(self):
+        if self.path == '/ping':
+            self.send_body(200, b'')
+        else:
+            self.send_error(404, 'Invalid endpoint')
 
     def do_POST(self):
         content_length = int(self.headers['Content-Length'])
@@ -49,15 +77,9 @@ class RequestHandler(BaseHTTPRequestHandler):
             try:
                 prediction = handler.predict(data)
             except Exception as e:
-                self.send_response(500)
-                self.send_header('Content-type', 'application/json')
-                self.end_headers()
-                self.wfile.write(str(e).encode('utf-8'))
+                self.send_body(500, str(e).encode('utf-8'))
                 return
-            self.send_response(200)
-            self.send_header('Content-type', 'application/json')
-            self.end_headers()
-            self.wfile.write(json.dumps(prediction).encode('utf-8'))
+            self.send_body(200, json.dumps(prediction).encode('utf-8'))
 
         else:
             logging.error('Invalid endpoint')
@@ -99,9 +121,15 @@ if __name__ == '__main__':
 
     load_thread = threading.Thread(target=notify_ready, name='ReadyNotifier')
     load_thread.start()
+    # headers and body are written separately, avoid the Nagle delay on kept-alive TCP connections
+    RequestHandler.disable_nagle_algorithm = not args.socket
     try:
-        server = HTTPServer(('127.0.0.1', args.port), RequestHandler)
-        logging.info(f'Python worker REST started at http://127.0.0.1:{args.port}')
+        if args.socket:
+            server = UnixHTTPServer(args.socket, RequestHandler)
+            logging.info(f'Python worker REST started at unix:{args.socket}')
+        else:
+            server = HTTPServer(('127.0.0.1', args.port), RequestHandler)
+            logging.info(f'Python worker REST started at http://127.0.0.1:{args.port}')
         server.serve_forever()
     except KeyboardInterrupt:
         logging.info('Stopping server...')
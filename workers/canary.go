@@ -0,0 +1,244 @@
+package workers
+
+import (
+	"fmt"
+	"model-hub/config"
+	"model-hub/models"
+	"time"
+)
+
+const (
+	CanaryRunning    = "running"
+	CanaryPromoted   = "promoted"
+	CanaryRolledBack = "rolled_back"
+
+	// canaryCheckInterval is how often a running canary is compared with its baseline.
+	canaryCheckInterval = time.Second
+)
+
+type CanaryStatus struct {
+	Alias    models.ModelName `json:"alias"`
+	Baseline models.ModelName `json:"baseline"`
+	Model    models.ModelName `json:"model"`
+	State    string           `json:"state"`
+	Reason   string           `json:"reason,omitempty"`
+	// Weight is the percentage of the traffic of the alias sent to Model.
+	Weight   int             `json:"weight"`
+	Variants []VariantStatus `json:"variants"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+}
+
+// canary moves the traffic of an alias step by step from the model it points to
+// to a new model. Its status and split are guarded by the aliases lock.
+type canary struct {
+	status   CanaryStatus
+	settings config.Canary
+	split    *trafficSplit                    // Current weights, nil once the canary finished
+	stats    map[models.ModelName]*modelStats // Statistics of the baseline and the new model since the start
+	stop     chan struct{}                    // Closed when the canary finished
+}
+
+// StartCanary retargets an alias progressively: the new model receives the
+// percentages of the alias traffic configured in its canary steps, and the alias
+// points to it once the last step passed. The canary is rolled back as soon as
+// the new model does worse than the baseline, the model the alias pointed to.
+func (wm *WorkerManager) StartCanary(alias models.ModelName, target models.ModelName) (CanaryStatus, error) {
+	if err := wm.checkAlias(alias, target); err != nil {
+		return CanaryStatus{}, err
+	}
+	model, _ := wm.modelConfig(target)
+	if model.Canary == nil {
+		return CanaryStatus{}, fmt.Errorf("model %s has no canary configuration", target)
+	}
+
+	wm.aliasesMu.Lock()
+	defer wm.aliasesMu.Unlock()
+
+	baseline, ok := wm.aliases[alias]
+	if !ok {
+		return CanaryStatus{}, fmt.Errorf("alias %s points to no model yet", alias)
+	}
+	if baseline == target {
+		return CanaryStatus{}, fmt.Errorf("alias %s already points to %s", alias, target)
+	}
+	if previous, ok := wm.canaries[alias]; ok && previous.status.State == CanaryRunning {
+		return CanaryStatus{}, fmt.Errorf("a canary of alias %s is already running", alias)
+	}
+
+	c := &canary{
+		status: CanaryStatus{
+			Alias:    alias,
+			Baseline: baseline,
+			Model:    target,
+			State:    CanaryRunning,
+			Started:  time.Now(),
+		},
+		settings: *model.Canary,
+		stats: map[models.ModelName]*modelStats{
+			baseline: {},
+			target:   {},
+		},
+		stop: make(chan struct{}),
+	}
+	wm.canaries[alias] = c
+	go wm.runCanary(c)
+	return c.statusLocked(), nil
+}
+
+// Canary returns the state of the last canary of the alias.
+func (wm *WorkerManager) Canary(alias models.ModelName) (CanaryStatus, bool) {
+	wm.aliasesMu.RLock()
+	defer wm.aliasesMu.RUnlock()
+
+	c, ok := wm.canaries[alias]
+	if !ok {
+		return CanaryStatus{}, false
+	}
+	return c.statusLocked(), true
+}
+
+// AbortCanary rolls back the running canary of the alias.
+func (wm *WorkerManager) AbortCanary(alias models.ModelName) (CanaryStatus, error) {
+	wm.aliasesMu.RLock()
+	c, ok := wm.canaries[alias]
+	wm.aliasesMu.RUnlock()
+	if !ok || !wm.finishCanary(c, CanaryRolledBack, "aborted through the admin API") {
+		return CanaryStatus{}, fmt.Errorf("no canary of alias %s is running", alias)
+	}
+	status, _ := wm.Canary(alias)
+	return status, nil
+}
+
+// canarySplit returns the traffic split of the running canary of the alias.
+func (wm *WorkerManager) canarySplit(alias models.ModelName) (*trafficSplit, bool) {
+	wm.aliasesMu.RLock()
+	defer wm.aliasesMu.RUnlock()
+
+	c, ok := wm.canaries[alias]
+	if !ok || c.split == nil {
+		return nil, false
+	}
+	return c.split, true
+}
+
+func (wm *WorkerManager) runCanary(c *canary) {
+	for _, weight := range c.settings.Steps {
+		if !wm.setCanaryWeight(c, weight) {
+			return
+		}
+		wm.logger.Info(fmt.Sprintf("Alias %s: canary %s receives %d%% of the traffic", c.status.Alias, c.status.Model, weight))
+
+		stepEnd := time.Now().Add(c.settings.StepDuration)
+		stepStart := c.stats[c.status.Model].status().Requests
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(canaryCheckInterval):
+			}
+			if reason := c.check(); reason != "" {
+				wm.finishCanary(c, CanaryRolledBack, reason)
+				return
+			}
+			requests := c.stats[c.status.Model].status().Requests - stepStart
+			if time.Now().After(stepEnd) && requests >= c.settings.MinRequests {
+				break
+			}
+		}
+	}
+	wm.finishCanary(c, CanaryPromoted, "")
+}
+
+// check compares the new model with the baseline and returns why the canary
+// must be rolled back, or an empty string while it does well enough.
+func (c *canary) check() string {
+	candidate := c.stats[c.status.Model]
+	baseline := c.stats[c.status.Baseline]
+	candidateStatus := candidate.status()
+	if candidateStatus.Requests < c.settings.MinRequests {
+		return ""
+	}
+
+	candidateErrors := errorRate(candidateStatus)
+	baselineErrors := errorRate(baseline.status())
+	if candidateErrors > baselineErrors+c.settings.MaxErrorRateIncrease {
+		return fmt.Sprintf("error rate %.1f%% exceeds the baseline's %.1f%% by more than %.1f%%",
+			candidateErrors*100, baselineErrors*100, c.settings.MaxErrorRateIncrease*100)
+	}
+
+	candidateP95, ok := candidate.percentile(95)
+	if !ok {
+		return ""
+	}
+	baselineP95, ok := baseline.percentile(95)
+	if ok && float64(candidateP95) > float64(baselineP95)*(1+c.settings.MaxLatencyIncrease) {
+		return fmt.Sprintf("p95 response time %s exceeds the baseline's %s by more than %.0f%%",
+			candidateP95, baselineP95, c.settings.MaxLatencyIncrease*100)
+	}
+	return ""
+}
+
+func errorRate(status ModelStatus) float64 {
+	if status.Requests == 0 {
+		return 0
+	}
+	return float64(status.Errors) / float64(status.Requests)
+}
+
+// setCanaryWeight sends weight percent of the alias traffic to the new model.
+// It returns false if the canary finished meanwhile.
+func (wm *WorkerManager) setCanaryWeight(c *canary, weight int) bool {
+	wm.aliasesMu.Lock()
+	defer wm.aliasesMu.Unlock()
+
+	if c.status.State != CanaryRunning {
+		return false
+	}
+	c.status.Weight = weight
+	c.split = &trafficSplit{
+		name: c.status.Alias,
+		// the new model comes first, so requests with a routing key stay on it as its weight grows
+		variants: []config.SplitVariant{
+			{Model: c.status.Model, Weight: weight},
+			{Model: c.status.Baseline, Weight: 100 - weight},
+		},
+		total: 100,
+		stats: c.stats,
+	}
+	return true
+}
+
+// finishCanary ends a running canary. A promoted canary retargets the alias to
+// the new model, a rolled back one leaves it on the baseline. It returns false
+// if the canary had already finished.
+func (wm *WorkerManager) finishCanary(c *canary, state string, reason string) bool {
+	wm.aliasesMu.Lock()
+	defer wm.aliasesMu.Unlock()
+
+	if c.status.State != CanaryRunning {
+		return false
+	}
+	finished := time.Now()
+	c.status.State = state
+	c.status.Reason = reason
+	c.status.Finished = &finished
+	c.split = nil
+	close(c.stop)
+	if state == CanaryRolledBack {
+		wm.logger.Warn(fmt.Sprintf("Alias %s: canary %s rolled back: %s", c.status.Alias, c.status.Model, reason))
+		return true
+	}
+	wm.aliases[c.status.Alias] = c.status.Model
+	wm.logger.Info(fmt.Sprintf("Alias %s: canary %s promoted, retargeted from %s", c.status.Alias, c.status.Model, c.status.Baseline))
+	return true
+}
+
+func (c *canary) statusLocked() CanaryStatus {
+	status := c.status
+	status.Variants = []VariantStatus{
+		newVariantStatus(c.status.Model, c.status.Weight, c.stats[c.status.Model]),
+		newVariantStatus(c.status.Baseline, 100-c.status.Weight, c.stats[c.status.Baseline]),
+	}
+	return status
+}
@@ -0,0 +1,86 @@
+package workers
+
+import (
+	"model-hub/config"
+	"model-hub/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStats returns statistics of requests answered in latency, errors of them failed.
+func testStats(requests int, errors int, latency time.Duration) *modelStats {
+	stats := &modelStats{}
+	for i := 0; i < requests; i++ {
+		if i < errors {
+			stats.observeError()
+		} else {
+			stats.observe(latency)
+		}
+	}
+	return stats
+}
+
+func TestCanaryCheck(t *testing.T) {
+	settings := config.Canary{
+		MinRequests:          20,
+		MaxErrorRateIncrease: 0.05,
+		MaxLatencyIncrease:   0.2,
+	}
+	tests := []struct {
+		name      string
+		candidate *modelStats
+		baseline  *modelStats
+		// substring of the rollback reason, empty if the canary does well enough
+		want string
+	}{
+		{
+			name:      "too few requests to decide",
+			candidate: testStats(19, 19, time.Second),
+			baseline:  testStats(100, 0, time.Millisecond),
+		},
+		{
+			name:      "as good as the baseline",
+			candidate: testStats(40, 1, 10*time.Millisecond),
+			baseline:  testStats(100, 2, 10*time.Millisecond),
+		},
+		{
+			name:      "error rate over the baseline",
+			candidate: testStats(40, 4, 10*time.Millisecond),
+			baseline:  testStats(100, 2, 10*time.Millisecond),
+			want:      "error rate",
+		},
+		{
+			name:      "slower than the baseline",
+			candidate: testStats(40, 0, 13*time.Millisecond),
+			baseline:  testStats(100, 0, 10*time.Millisecond),
+			want:      "p95 response time",
+		},
+		{
+			name:      "slightly slower than the baseline",
+			candidate: testStats(40, 0, 11*time.Millisecond),
+			baseline:  testStats(100, 0, 10*time.Millisecond),
+		},
+		{
+			name:      "baseline without response times",
+			candidate: testStats(40, 0, time.Second),
+			baseline:  testStats(0, 0, 0),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &canary{
+				status:   CanaryStatus{Model: "m@2", Baseline: "m@1"},
+				settings: settings,
+				stats:    map[models.ModelName]*modelStats{"m@2": test.candidate, "m@1": test.baseline},
+			}
+			reason := c.check()
+			if test.want == "" && reason != "" {
+				t.Errorf("rolled back: %s", reason)
+			}
+			if test.want != "" && !strings.Contains(reason, test.want) {
+				t.Errorf("reason %q, want one about the %s", reason, test.want)
+			}
+		})
+	}
+}
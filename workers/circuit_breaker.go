@@ -0,0 +1,159 @@
+package workers
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"model-hub/config"
+	"model-hub/models"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitOpenError is returned for requests to a model whose circuit breaker is open.
+type CircuitOpenError struct {
+	Model      models.ModelName
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("model %s is unavailable: %s", e.Model, e.Reason)
+}
+
+// circuitBreaker tracks the outcome of the last requests of a model. It opens
+// when too many of them failed, rejecting requests until the open period is
+// over. Then a few trial requests are let through (half-open) and the breaker
+// closes if all of them succeed, or opens again on the first failure.
+type circuitBreaker struct {
+	model    models.ModelName
+	config   config.CircuitBreaker
+	state    string
+	outcomes []bool // recent requests, true if failed
+	next     int
+	failures int
+	openedAt time.Time
+	reason   string
+	probes   int // trial requests in progress
+	passed   int // trial requests that succeeded
+	mu       sync.Mutex
+	logger   *zap.Logger
+}
+
+func newCircuitBreaker(model config.Model, logger *zap.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		model:  model.Name,
+		config: *model.CircuitBreaker,
+		state:  CircuitClosed,
+		logger: logger,
+	}
+}
+
+// allow returns an error if the request must not be sent to the model. probe
+// is true for trial requests, which must report their outcome.
+func (b *circuitBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if remaining := b.config.OpenFor - time.Since(b.openedAt); remaining > 0 {
+			return false, &CircuitOpenError{Model: b.model, Reason: b.reason, RetryAfter: remaining}
+		}
+		b.state = CircuitHalfOpen
+		b.probes = 0
+		b.passed = 0
+		b.logger.Info(fmt.Sprintf("Model %s: circuit breaker half-open, sending trial requests", b.model))
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probes+b.passed >= b.config.Probes {
+			return false, &CircuitOpenError{Model: b.model, Reason: b.reason + ", waiting for trial requests", RetryAfter: time.Second}
+		}
+		b.probes++
+		return true, nil
+	}
+	return false, nil
+}
+
+// record reports the outcome of a request that was allowed.
+func (b *circuitBreaker) record(probe bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probes--
+		if b.state != CircuitHalfOpen {
+			return
+		}
+		if failed {
+			b.open("trial request failed")
+			return
+		}
+		b.passed++
+		if b.passed >= b.config.Probes {
+			b.close()
+		}
+		return
+	}
+	if b.state != CircuitClosed {
+		// started before the breaker opened
+		return
+	}
+
+	if len(b.outcomes) < b.config.Window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.config.Window
+	}
+	if failed {
+		b.failures++
+	}
+	if len(b.outcomes) == b.config.Window && float64(b.failures) >= b.config.ErrorRate*float64(b.config.Window) {
+		b.open(fmt.Sprintf("%d of the last %d requests failed", b.failures, b.config.Window))
+	}
+}
+
+// abandon gives up a trial request that ended without an outcome, e.g. because
+// the client went away.
+func (b *circuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probes--
+}
+
+func (b *circuitBreaker) open(reason string) {
+	b.state = CircuitOpen
+	b.openedAt = time.Now()
+	b.reason = reason
+	b.logger.Warn(fmt.Sprintf("Model %s: circuit breaker open for %s: %s", b.model, b.config.OpenFor, reason))
+}
+
+func (b *circuitBreaker) close() {
+	b.state = CircuitClosed
+	b.reason = ""
+	b.outcomes = b.outcomes[:0]
+	b.next = 0
+	b.failures = 0
+	b.logger.Info(fmt.Sprintf("Model %s: circuit breaker closed", b.model))
+}
+
+// status returns the state of the breaker and why it is not closed.
+func (b *circuitBreaker) status() (state string, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.reason
+}
@@ -0,0 +1,147 @@
+package workers
+
+import (
+	"errors"
+	"model-hub/config"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestBreaker(probes int) *circuitBreaker {
+	return newCircuitBreaker(config.Model{
+		Name: "m",
+		CircuitBreaker: &config.CircuitBreaker{
+			ErrorRate: 0.5,
+			Window:    4,
+			OpenFor:   time.Minute,
+			Probes:    probes,
+		},
+	}, zap.NewNop())
+}
+
+// expire ends the open period of the breaker.
+func expire(b *circuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openedAt = time.Now().Add(-b.config.OpenFor)
+}
+
+// allowed asks the breaker for a request and fails the test if it is rejected.
+func allowed(t *testing.T, b *circuitBreaker) bool {
+	t.Helper()
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatalf("request rejected: %v", err)
+	}
+	return probe
+}
+
+func assertState(t *testing.T, b *circuitBreaker, want string) {
+	t.Helper()
+	if state, reason := b.status(); state != want {
+		t.Fatalf("state %s (%s), want %s", state, reason, want)
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	b := newTestBreaker(1)
+	for _, failed := range []bool{false, true, false} {
+		b.record(allowed(t, b), failed)
+	}
+	// the window is not full yet
+	assertState(t, b, CircuitClosed)
+	b.record(allowed(t, b), true)
+	assertState(t, b, CircuitOpen)
+
+	_, err := b.allow()
+	var circuitErr *CircuitOpenError
+	if !errors.As(err, &circuitErr) {
+		t.Fatalf("request to an open breaker: got %v, want a CircuitOpenError", err)
+	}
+	if circuitErr.RetryAfter <= 0 || circuitErr.RetryAfter > time.Minute {
+		t.Errorf("retry after %s, want the rest of the open period", circuitErr.RetryAfter)
+	}
+	// requests started before the breaker opened do not change it
+	b.record(false, false)
+	assertState(t, b, CircuitOpen)
+}
+
+func TestCircuitBreakerSlidingWindow(t *testing.T) {
+	b := newTestBreaker(1)
+	// one failure in every four requests never reaches the error rate
+	for i := 0; i < 12; i++ {
+		b.record(allowed(t, b), i%4 == 0)
+	}
+	assertState(t, b, CircuitClosed)
+	// two failures in the last four requests reach it
+	for _, failed := range []bool{true, false, true} {
+		b.record(allowed(t, b), failed)
+	}
+	assertState(t, b, CircuitOpen)
+}
+
+func TestCircuitBreakerCloses(t *testing.T) {
+	b := newTestBreaker(2)
+	for i := 0; i < 4; i++ {
+		b.record(allowed(t, b), true)
+	}
+	assertState(t, b, CircuitOpen)
+	expire(b)
+
+	first, second := allowed(t, b), allowed(t, b)
+	if !first || !second {
+		t.Fatal("requests after the open period are not trial requests")
+	}
+	assertState(t, b, CircuitHalfOpen)
+	if _, err := b.allow(); err == nil {
+		t.Fatal("more trial requests let through than configured")
+	}
+	b.record(first, false)
+	assertState(t, b, CircuitHalfOpen)
+	b.record(second, false)
+	assertState(t, b, CircuitClosed)
+
+	// the failures from before the breaker opened are forgotten
+	for _, failed := range []bool{true, false, false} {
+		b.record(allowed(t, b), failed)
+	}
+	if probe := allowed(t, b); probe {
+		t.Error("request to a closed breaker is a trial request")
+	}
+	assertState(t, b, CircuitClosed)
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	b := newTestBreaker(2)
+	for i := 0; i < 4; i++ {
+		b.record(allowed(t, b), true)
+	}
+	expire(b)
+	first, second := allowed(t, b), allowed(t, b)
+	b.record(first, true)
+	assertState(t, b, CircuitOpen)
+	// the other trial request ends after the breaker opened again
+	b.record(second, false)
+	assertState(t, b, CircuitOpen)
+	if _, err := b.allow(); err == nil {
+		t.Error("request let through right after a trial request failed")
+	}
+}
+
+func TestCircuitBreakerAbandonedProbe(t *testing.T) {
+	b := newTestBreaker(1)
+	for i := 0; i < 4; i++ {
+		b.record(allowed(t, b), true)
+	}
+	expire(b)
+	b.abandon(allowed(t, b))
+	// the trial is sent again with the next request
+	probe := allowed(t, b)
+	if !probe {
+		t.Fatal("request after an abandoned trial request is not a trial request")
+	}
+	b.record(probe, false)
+	assertState(t, b, CircuitClosed)
+}
@@ -0,0 +1,325 @@
+package workers
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math"
+	"model-hub/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTenantLimit is returned when a tenant already has the maximum number of
+// queued or concurrent requests.
+var ErrTenantLimit = errors.New("tenant request limit exceeded")
+
+// dispatcher matches the idle workers of one model with its queued requests.
+// Whenever a request is queued or a worker is released, idle workers are
+// handed to the next requests chosen by the model's scheduler. Idle workers
+// are used in FIFO order.
+type dispatcher struct {
+	model     config.Model
+	scheduler Scheduler
+	idle      []*Worker
+	isIdle    map[WorkerId]bool
+	busy      map[WorkerId]string // tenant of the request each busy worker serves
+	tenants   map[string]*tenantUsage
+	agingRate float64 // priority gained per second of waiting, for logging
+	seq       uint64
+	mu        sync.Mutex
+	logger    *zap.Logger
+}
+
+type tenantUsage struct {
+	queued   int
+	running  int
+	served   int
+	rejected int
+}
+
+func newDispatcher(model config.Model, logger *zap.Logger) (*dispatcher, error) {
+	d := &dispatcher{
+		model:   model,
+		isIdle:  make(map[WorkerId]bool),
+		busy:    make(map[WorkerId]string),
+		tenants: make(map[string]*tenantUsage),
+		logger:  logger,
+	}
+	scheduler, err := newScheduler(model)
+	if err != nil {
+		return nil, err
+	}
+	d.scheduler = scheduler
+	if model.Aging != nil {
+		d.agingRate = model.Aging.Step / model.Aging.Interval.Seconds()
+	}
+	return d, nil
+}
+
+// acquire queues the request and dispatches it if a worker is idle. The worker
+// is delivered on request.resultChan.
+func (d *dispatcher) acquire(request *WorkerRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.overLimit(request.tenant) {
+		d.usage(request.tenant).rejected++
+		return ErrTenantLimit
+	}
+
+	request.enqueuedAt = time.Now()
+	d.seq++
+	request.seq = d.seq
+	d.scheduler.Push(request)
+	d.usage(request.tenant).queued++
+	d.dispatch()
+	return nil
+}
+
+// tryAcquire assigns an idle worker to the request without queueing it. It
+// returns nil if no worker is idle or other requests are waiting for one.
+func (d *dispatcher) tryAcquire(request *WorkerRequest) *Worker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.scheduler.Len() > 0 || d.overLimit(request.tenant) {
+		return nil
+	}
+	if reserve := d.model.Reserve; reserve != nil && len(d.idle) <= reserve.Workers && request.priority < reserve.MinPriority {
+		return nil
+	}
+	worker := d.popIdle()
+	if worker == nil {
+		return nil
+	}
+	request.enqueuedAt = time.Now()
+	d.usage(request.tenant).queued++
+	d.assign(request, worker)
+	return <-request.resultChan
+}
+
+// cancel removes a request that is still waiting. It returns false if a worker
+// was already assigned to it.
+func (d *dispatcher) cancel(request *WorkerRequest) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.scheduler.Remove(request) {
+		return false
+	}
+	d.usage(request.tenant).queued--
+	d.forgetIdle(request.tenant)
+	return true
+}
+
+// release returns the worker after a request and hands it to the next waiting one.
+func (d *dispatcher) release(worker *Worker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if tenant, ok := d.busy[worker.ID]; ok {
+		delete(d.busy, worker.ID)
+		d.usage(tenant).running--
+		d.forgetIdle(tenant)
+	}
+	if d.isIdle[worker.ID] || !worker.IsLoaded() {
+		return
+	}
+	d.idle = append(d.idle, worker)
+	d.isIdle[worker.ID] = true
+	d.dispatch()
+}
+
+// remove stops handing out the worker until it is released again.
+func (d *dispatcher) remove(worker *Worker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.removeIdle(worker)
+}
+
+// drop forgets a worker that leaves the model. The running slot of the request
+// it serves is given back now, as the worker is never released to the dispatcher again.
+func (d *dispatcher) drop(worker *Worker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.removeIdle(worker)
+	if tenant, ok := d.busy[worker.ID]; ok {
+		delete(d.busy, worker.ID)
+		d.usage(tenant).running--
+		d.forgetIdle(tenant)
+		d.dispatch()
+	}
+}
+
+// swap retires the old workers and hands out the new ones instead, in one step.
+func (d *dispatcher) swap(old []*Worker, new []*Worker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, worker := range old {
+		worker.Retire()
+		d.removeIdle(worker)
+	}
+	for _, worker := range new {
+		worker.setStandby(false)
+		if worker.IsLoaded() && !d.isIdle[worker.ID] {
+			d.idle = append(d.idle, worker)
+			d.isIdle[worker.ID] = true
+		}
+	}
+	d.dispatch()
+}
+
+func (d *dispatcher) removeIdle(worker *Worker) {
+	if !d.isIdle[worker.ID] {
+		return
+	}
+	delete(d.isIdle, worker.ID)
+	for i, idle := range d.idle {
+		if idle == worker {
+			d.idle = append(d.idle[:i], d.idle[i+1:]...)
+			break
+		}
+	}
+}
+
+// dispatch assigns idle workers to queued requests as long as both are available.
+// The last reserved workers are only given to requests of the reserved priority.
+func (d *dispatcher) dispatch() {
+	for len(d.idle) > 0 && d.scheduler.Len() > 0 {
+		worker := d.popIdle()
+		if worker == nil {
+			return
+		}
+		minPriority := math.MinInt
+		if reserve := d.model.Reserve; reserve != nil && len(d.idle)+1 <= reserve.Workers {
+			minPriority = reserve.MinPriority
+		}
+		request := d.scheduler.Pop(minPriority)
+		if request == nil {
+			// everything queued is below the reserved priority
+			d.idle = append([]*Worker{worker}, d.idle...)
+			d.isIdle[worker.ID] = true
+			return
+		}
+		d.assign(request, worker)
+	}
+}
+
+func (d *dispatcher) popIdle() *Worker {
+	for len(d.idle) > 0 {
+		worker := d.idle[0]
+		d.idle[0] = nil
+		d.idle = d.idle[1:]
+		delete(d.isIdle, worker.ID)
+		if worker.IsLoaded() {
+			return worker
+		}
+	}
+	return nil
+}
+
+func (d *dispatcher) assign(request *WorkerRequest, worker *Worker) {
+	if d.agingRate > 0 {
+		waited := time.Since(request.enqueuedAt)
+		effective := float64(request.priority) + d.agingRate*waited.Seconds()
+		d.logger.Info(fmt.Sprintf("Model %s: dispatching to worker %s (priority: %d, effective priority: %.2f, waited: %s)",
+			d.model.Name, worker.ID, request.priority, effective, waited.Round(time.Millisecond)))
+	}
+	usage := d.usage(request.tenant)
+	usage.queued--
+	usage.running++
+	usage.served++
+	d.busy[worker.ID] = request.tenant
+
+	request.worker = worker
+	worker.SetBusy()
+	request.resultChan <- worker
+}
+
+// forgetIdle drops the usage of a tenant without its own entry in the model
+// configuration once it has no queued or running requests, so tenant names
+// chosen by clients do not pile up.
+func (d *dispatcher) forgetIdle(tenant string) {
+	usage, ok := d.tenants[tenant]
+	if !ok || usage.queued > 0 || usage.running > 0 {
+		return
+	}
+	if _, configured := d.model.Tenants[tenant]; configured || tenant == config.DefaultTenant {
+		return
+	}
+	delete(d.tenants, tenant)
+}
+
+func (d *dispatcher) usage(tenant string) *tenantUsage {
+	usage, ok := d.tenants[tenant]
+	if !ok {
+		usage = &tenantUsage{}
+		d.tenants[tenant] = usage
+	}
+	return usage
+}
+
+// overLimit reports whether another request of the tenant would exceed its
+// limits. Requests count towards max_concurrent from the moment they are
+// queued, so no scheduler can run more of them at once.
+func (d *dispatcher) overLimit(tenant string) bool {
+	usage, ok := d.tenants[tenant]
+	if !ok {
+		return false
+	}
+	limits := d.model.TenantConfig(tenant)
+	if limits.MaxQueued > 0 && usage.queued >= limits.MaxQueued {
+		return true
+	}
+	return limits.MaxConcurrent > 0 && usage.queued+usage.running >= limits.MaxConcurrent
+}
+
+// stats returns the number of queued requests and idle workers.
+func (d *dispatcher) stats() (queued int, idle int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.scheduler.Len(), len(d.idle)
+}
+
+type TenantStatus struct {
+	Tenant        string  `json:"tenant"`
+	Weight        float64 `json:"weight"`
+	Queued        int     `json:"queued"`
+	Running       int     `json:"running"`
+	Served        int     `json:"served"`
+	Rejected      int     `json:"rejected"`
+	MaxConcurrent int     `json:"max_concurrent"`
+	MaxQueued     int     `json:"max_queued"`
+}
+
+func (d *dispatcher) tenantsStatus() []TenantStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	statuses := make([]TenantStatus, 0, len(d.tenants))
+	for name, usage := range d.tenants {
+		tenant := d.model.TenantConfig(name)
+		weight := tenant.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		statuses = append(statuses, TenantStatus{
+			Tenant:        name,
+			Weight:        weight,
+			Queued:        usage.queued,
+			Running:       usage.running,
+			Served:        usage.served,
+			Rejected:      usage.rejected,
+			MaxConcurrent: tenant.MaxConcurrent,
+			MaxQueued:     tenant.MaxQueued,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Tenant < statuses[j].Tenant })
+	return statuses
+}
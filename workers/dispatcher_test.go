@@ -0,0 +1,516 @@
+package workers
+
+import (
+	"fmt"
+	"model-hub/config"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// concurrentRequests is the number of goroutines acquiring and releasing
+// workers at once in the concurrency tests.
+const concurrentRequests = 10000
+
+// newTestDispatcher returns a dispatcher with the given number of idle, loaded workers.
+func newTestDispatcher(t testing.TB, model config.Model, workers int) (*dispatcher, []*Worker) {
+	t.Helper()
+	model.Name = "m"
+	d, err := newDispatcher(model, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := make([]*Worker, workers)
+	for i := range idle {
+		idle[i] = &Worker{ID: WorkerId(fmt.Sprintf("m-%d", i+1)), Model: model, Loaded: true}
+		d.release(idle[i])
+	}
+	return d, idle
+}
+
+// assigned returns the worker assigned to the request, or nil if it still waits.
+func assigned(request *WorkerRequest) *Worker {
+	select {
+	case worker := <-request.resultChan:
+		return worker
+	default:
+		return nil
+	}
+}
+
+// waitForQueued waits until the dispatcher holds queued requests.
+func waitForQueued(t *testing.T, d *dispatcher, queued int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if n, _ := d.stats(); n == queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests were not queued", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcherMatching(t *testing.T) {
+	d, idle := newTestDispatcher(t, config.Model{}, 1)
+	first := NewWorkerRequest(RequestOptions{Priority: 1})
+	if err := d.acquire(first); err != nil {
+		t.Fatal(err)
+	}
+	if assigned(first) != idle[0] {
+		t.Fatal("idle worker not assigned right away")
+	}
+
+	low, high, cancelled := NewWorkerRequest(RequestOptions{Priority: 1}), NewWorkerRequest(RequestOptions{Priority: 5}), NewWorkerRequest(RequestOptions{Priority: 9})
+	for _, request := range []*WorkerRequest{low, high, cancelled} {
+		if err := d.acquire(request); err != nil {
+			t.Fatal(err)
+		}
+		if assigned(request) != nil {
+			t.Fatal("request assigned while no worker is idle")
+		}
+	}
+	if !d.cancel(cancelled) {
+		t.Fatal("waiting request not cancelled")
+	}
+
+	d.release(idle[0])
+	if assigned(high) != idle[0] || assigned(low) != nil {
+		t.Fatal("released worker not handed to the highest priority request")
+	}
+	if d.cancel(high) {
+		t.Error("assigned request cancelled")
+	}
+	d.release(idle[0])
+	if assigned(low) != idle[0] {
+		t.Fatal("released worker not handed to the last waiting request")
+	}
+	d.release(idle[0])
+	if queued, idle := d.stats(); queued != 0 || idle != 1 {
+		t.Errorf("%d queued requests and %d idle workers, want 0 and 1", queued, idle)
+	}
+}
+
+func TestDispatcherEqualPrioritiesInArrivalOrder(t *testing.T) {
+	d, idle := newTestDispatcher(t, config.Model{}, 1)
+	d.remove(idle[0])
+	requests := make([]*WorkerRequest, 10)
+	for i := range requests {
+		requests[i] = NewWorkerRequest(RequestOptions{Priority: 1})
+		if err := d.acquire(requests[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, request := range requests {
+		d.release(idle[0])
+		if assigned(request) != idle[0] {
+			t.Fatalf("request %d not served in arrival order", i)
+		}
+	}
+}
+
+func TestDispatcherReserve(t *testing.T) {
+	reserve := &config.Reserve{Workers: 1, MinPriority: 10}
+	tests := []struct {
+		name      string
+		scheduler string
+		// priorities of the requests acquired in order, with two workers
+		priorities []int
+		// whether each request gets a worker right away
+		want []bool
+	}{
+		{
+			name:       "low priority leaves the reserved worker",
+			scheduler:  config.SchedulerPriority,
+			priorities: []int{1, 1},
+			want:       []bool{true, false},
+		},
+		{
+			name:       "reserved worker goes to high priority",
+			scheduler:  config.SchedulerPriority,
+			priorities: []int{1, 1, 10},
+			want:       []bool{true, false, true},
+		},
+		{
+			name:       "high priority may take every worker",
+			scheduler:  config.SchedulerFIFO,
+			priorities: []int{10, 10, 1},
+			want:       []bool{true, true, false},
+		},
+		{
+			name:       "fair scheduler keeps the reserve",
+			scheduler:  config.SchedulerFair,
+			priorities: []int{1, 1, 10},
+			want:       []bool{true, false, true},
+		},
+		{
+			name:       "edf scheduler keeps the reserve",
+			scheduler:  config.SchedulerEDF,
+			priorities: []int{1, 1, 12},
+			want:       []bool{true, false, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, _ := newTestDispatcher(t, config.Model{Scheduler: test.scheduler, Workers: 2, Reserve: reserve}, 2)
+			for i, priority := range test.priorities {
+				request := NewWorkerRequest(RequestOptions{Priority: priority})
+				if err := d.acquire(request); err != nil {
+					t.Fatal(err)
+				}
+				if got := assigned(request) != nil; got != test.want[i] {
+					t.Errorf("request %d with priority %d: assigned %t, want %t", i, priority, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcherReserveOnRelease(t *testing.T) {
+	d, _ := newTestDispatcher(t, config.Model{
+		Scheduler: config.SchedulerPriority,
+		Workers:   2,
+		Reserve:   &config.Reserve{Workers: 1, MinPriority: 10},
+	}, 2)
+	first := NewWorkerRequest(RequestOptions{Priority: 1})
+	waiting := NewWorkerRequest(RequestOptions{Priority: 1})
+	high := NewWorkerRequest(RequestOptions{Priority: 10})
+	for _, request := range []*WorkerRequest{first, waiting, high} {
+		if err := d.acquire(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	firstWorker, highWorker := assigned(first), assigned(high)
+	if firstWorker == nil || highWorker == nil || assigned(waiting) != nil {
+		t.Fatal("unexpected assignment before any release")
+	}
+
+	// the released worker is the only idle one, so it stays reserved
+	d.release(firstWorker)
+	if assigned(waiting) != nil {
+		t.Fatal("reserved worker given to a low priority request")
+	}
+	// with two idle workers the first one is no longer reserved
+	d.release(highWorker)
+	if worker := assigned(waiting); worker != firstWorker {
+		t.Fatalf("waiting request got worker %v, want %s", worker, firstWorker.ID)
+	}
+	if _, idle := d.stats(); idle != 1 {
+		t.Errorf("%d idle workers, want 1", idle)
+	}
+}
+
+func TestDispatcherTryAcquireReserve(t *testing.T) {
+	d, _ := newTestDispatcher(t, config.Model{
+		Scheduler: config.SchedulerPriority,
+		Workers:   2,
+		Reserve:   &config.Reserve{Workers: 1, MinPriority: 10},
+	}, 2)
+	if d.tryAcquire(NewWorkerRequest(RequestOptions{Priority: 1})) == nil {
+		t.Fatal("unreserved worker not given to a low priority request")
+	}
+	if d.tryAcquire(NewWorkerRequest(RequestOptions{Priority: 1})) != nil {
+		t.Fatal("reserved worker given to a low priority request")
+	}
+	if d.tryAcquire(NewWorkerRequest(RequestOptions{Priority: 10})) == nil {
+		t.Fatal("reserved worker not given to a high priority request")
+	}
+}
+
+func BenchmarkDispatcher(b *testing.B) {
+	for _, scheduler := range []string{config.SchedulerPriority, config.SchedulerFIFO, config.SchedulerEDF, config.SchedulerFair} {
+		b.Run(scheduler, func(b *testing.B) {
+			d, _ := newTestDispatcher(b, config.Model{
+				Scheduler: scheduler,
+				Tenants:   map[string]config.Tenant{"a": {Weight: 3}, "b": {Weight: 1}},
+			}, 8)
+			b.SetParallelism(concurrentRequests / runtime.GOMAXPROCS(0))
+			b.ReportAllocs()
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					request := NewWorkerRequest(RequestOptions{
+						Priority: int(i % 5),
+						Tenant:   []string{"a", "b"}[i%2],
+						Deadline: time.Now().Add(time.Duration(i%100) * time.Millisecond),
+					})
+					if err := d.acquire(request); err != nil {
+						b.Error(err)
+						return
+					}
+					d.release(<-request.resultChan)
+				}
+			})
+		})
+	}
+}
+
+func TestDispatcherPriorityUnderConcurrency(t *testing.T) {
+	const priorities = 5
+	// with a single worker, requests are served in the order they are assigned
+	d, idle := newTestDispatcher(t, config.Model{}, 1)
+	// queue every request before the worker is free, so all of them compete
+	d.remove(idle[0])
+
+	var (
+		mu    sync.Mutex
+		order []int
+		done  sync.WaitGroup
+	)
+	for i := 0; i < concurrentRequests; i++ {
+		done.Add(1)
+		go func(priority int) {
+			defer done.Done()
+			request := NewWorkerRequest(RequestOptions{Priority: priority})
+			if err := d.acquire(request); err != nil {
+				t.Error(err)
+				return
+			}
+			worker := <-request.resultChan
+			mu.Lock()
+			order = append(order, priority)
+			mu.Unlock()
+			d.release(worker)
+		}(i % priorities)
+	}
+	waitForQueued(t, d, concurrentRequests)
+	d.release(idle[0])
+	done.Wait()
+
+	if len(order) != concurrentRequests {
+		t.Fatalf("%d requests served, want %d", len(order), concurrentRequests)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] > order[i-1] {
+			t.Fatalf("request %d of priority %d served after one of priority %d", i, order[i], order[i-1])
+		}
+	}
+	if queued, idle := d.stats(); queued != 0 || idle != 1 {
+		t.Errorf("%d queued requests and %d idle workers left, want 0 and 1", queued, idle)
+	}
+}
+
+func TestDispatcherFairnessUnderConcurrency(t *testing.T) {
+	d, idle := newTestDispatcher(t, config.Model{
+		Scheduler: config.SchedulerFair,
+		Tenants: map[string]config.Tenant{
+			"a": {Weight: 3},
+			"b": {Weight: 1},
+		},
+	}, 1)
+	d.remove(idle[0])
+
+	var (
+		mu    sync.Mutex
+		order []string
+		done  sync.WaitGroup
+	)
+	for i := 0; i < concurrentRequests; i++ {
+		done.Add(1)
+		go func(tenant string) {
+			defer done.Done()
+			request := NewWorkerRequest(RequestOptions{Tenant: tenant})
+			if err := d.acquire(request); err != nil {
+				t.Error(err)
+				return
+			}
+			worker := <-request.resultChan
+			mu.Lock()
+			order = append(order, tenant)
+			mu.Unlock()
+			d.release(worker)
+		}([]string{"a", "b"}[i%2])
+	}
+	waitForQueued(t, d, concurrentRequests)
+	d.release(idle[0])
+	done.Wait()
+
+	if len(order) != concurrentRequests {
+		t.Fatalf("%d requests served, want %d", len(order), concurrentRequests)
+	}
+	// while both tenants have requests waiting, a gets three workers for one of b
+	served := make(map[string]int)
+	for _, tenant := range order[:concurrentRequests/2] {
+		served[tenant]++
+	}
+	if want := concurrentRequests / 2 * 3 / 4; served["a"] < want-1 || served["a"] > want+1 {
+		t.Errorf("tenant a served %d and b %d requests, want a ratio of 3", served["a"], served["b"])
+	}
+}
+
+// tenantStatus returns the statistics of a tenant of the dispatcher.
+func tenantStatus(d *dispatcher, tenant string) TenantStatus {
+	for _, status := range d.tenantsStatus() {
+		if status.Tenant == tenant {
+			return status
+		}
+	}
+	return TenantStatus{}
+}
+
+func TestDispatcherTenantLimits(t *testing.T) {
+	for _, scheduler := range []string{config.SchedulerPriority, config.SchedulerFIFO, config.SchedulerEDF, config.SchedulerFair} {
+		t.Run(scheduler, func(t *testing.T) {
+			d, idle := newTestDispatcher(t, config.Model{
+				Scheduler: scheduler,
+				Tenants: map[string]config.Tenant{
+					"a": {MaxConcurrent: 2, MaxQueued: 1},
+				},
+			}, 1)
+			first, second := NewWorkerRequest(RequestOptions{Tenant: "a"}), NewWorkerRequest(RequestOptions{Tenant: "a"})
+			for _, request := range []*WorkerRequest{first, second} {
+				if err := d.acquire(request); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if assigned(first) != idle[0] || assigned(second) != nil {
+				t.Fatal("requests of tenant a not queued behind the busy worker")
+			}
+			// one running and one queued request
+			if err := d.acquire(NewWorkerRequest(RequestOptions{Tenant: "a"})); err != ErrTenantLimit {
+				t.Fatalf("request over max_concurrent: got %v, want %v", err, ErrTenantLimit)
+			}
+			if status := tenantStatus(d, "a"); status.Queued != 1 || status.Running != 1 || status.Rejected != 1 {
+				t.Errorf("tenant a: %+v, want 1 queued, 1 running and 1 rejected", status)
+			}
+			// the first request finished, the second one runs
+			d.release(idle[0])
+			if assigned(second) != idle[0] {
+				t.Fatal("released worker not handed to the queued request of tenant a")
+			}
+			if err := d.acquire(NewWorkerRequest(RequestOptions{Tenant: "a"})); err != nil {
+				t.Errorf("request within the limits rejected: %v", err)
+			}
+			// other tenants have no limits
+			for i := 0; i < 3; i++ {
+				if err := d.acquire(NewWorkerRequest(RequestOptions{Tenant: "b"})); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcherMaxQueued(t *testing.T) {
+	d, idle := newTestDispatcher(t, config.Model{
+		Tenants: map[string]config.Tenant{"a": {MaxQueued: 2}},
+	}, 1)
+	d.remove(idle[0])
+	for i := 0; i < 2; i++ {
+		if err := d.acquire(NewWorkerRequest(RequestOptions{Tenant: "a"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.acquire(NewWorkerRequest(RequestOptions{Tenant: "a"})); err != ErrTenantLimit {
+		t.Fatalf("request over max_queued: got %v, want %v", err, ErrTenantLimit)
+	}
+	if status := tenantStatus(d, "a"); status.Queued != 2 || status.Rejected != 1 {
+		t.Errorf("tenant a: %+v, want 2 queued and 1 rejected", status)
+	}
+}
+
+func TestDispatcherConcurrencyLimitUnderConcurrency(t *testing.T) {
+	const (
+		workers = 4
+		limit   = 2
+	)
+	for _, scheduler := range []string{config.SchedulerPriority, config.SchedulerFIFO, config.SchedulerEDF, config.SchedulerFair} {
+		t.Run(scheduler, func(t *testing.T) {
+			d, _ := newTestDispatcher(t, config.Model{
+				Scheduler: scheduler,
+				Tenants: map[string]config.Tenant{
+					"limited": {MaxConcurrent: limit},
+					"other":   {},
+				},
+			}, workers)
+
+			var (
+				mu       sync.Mutex
+				running  int
+				peak     int
+				rejected atomic.Int64
+				done     sync.WaitGroup
+			)
+			for i := 0; i < concurrentRequests; i++ {
+				done.Add(1)
+				go func(tenant string) {
+					defer done.Done()
+					request := NewWorkerRequest(RequestOptions{Tenant: tenant, Priority: len(tenant)})
+					if err := d.acquire(request); err != nil {
+						if tenant != "limited" || err != ErrTenantLimit {
+							t.Error(err)
+						}
+						rejected.Add(1)
+						return
+					}
+					worker := <-request.resultChan
+					if tenant == "limited" {
+						mu.Lock()
+						running++
+						peak = max(peak, running)
+						mu.Unlock()
+						runtime.Gosched()
+						mu.Lock()
+						running--
+						mu.Unlock()
+					}
+					d.release(worker)
+				}([]string{"limited", "other"}[i%2])
+			}
+			done.Wait()
+
+			if peak > limit {
+				t.Errorf("tenant limited ran %d requests at once, want at most %d", peak, limit)
+			}
+			if queued, idle := d.stats(); queued != 0 || idle != workers {
+				t.Errorf("%d queued requests and %d idle workers left, want 0 and %d", queued, idle, workers)
+			}
+			limited, other := tenantStatus(d, "limited"), tenantStatus(d, "other")
+			if limited.Served+limited.Rejected != concurrentRequests/2 || int64(limited.Rejected) != rejected.Load() {
+				t.Errorf("tenant limited: %+v, want %d requests served or rejected", limited, concurrentRequests/2)
+			}
+			if other.Served != concurrentRequests/2 || other.Queued != 0 || other.Running != 0 {
+				t.Errorf("tenant other: %+v, want %d served and nothing left", other, concurrentRequests/2)
+			}
+		})
+	}
+}
+
+func TestDispatcherForgetsIdleUnconfiguredTenants(t *testing.T) {
+	d, idle := newTestDispatcher(t, config.Model{
+		Tenants: map[string]config.Tenant{"a": {}},
+	}, 1)
+	for _, tenant := range []string{"a", config.DefaultTenant, "client-1", "client-2"} {
+		request := NewWorkerRequest(RequestOptions{Tenant: tenant})
+		if err := d.acquire(request); err != nil {
+			t.Fatal(err)
+		}
+		d.release(<-request.resultChan)
+	}
+
+	d.remove(idle[0])
+	waiting := NewWorkerRequest(RequestOptions{Tenant: "client-3"})
+	if err := d.acquire(waiting); err != nil {
+		t.Fatal(err)
+	}
+	if status := tenantStatus(d, "client-3"); status.Queued != 1 {
+		t.Fatalf("tenant client-3: %+v, want 1 queued", status)
+	}
+	d.cancel(waiting)
+
+	var tenants []string
+	for _, status := range d.tenantsStatus() {
+		tenants = append(tenants, status.Tenant)
+	}
+	if want := []string{"a", config.DefaultTenant}; !reflect.DeepEqual(tenants, want) {
+		t.Errorf("tenants %v, want %v", tenants, want)
+	}
+}
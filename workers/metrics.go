@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
-	"github.com/shirou/gopsutil/v3/process"
 	"go.uber.org/zap"
 	"model-hub/helper"
 	"os/exec"
@@ -18,6 +17,7 @@ type WorkerInfo struct {
 	ElapsedTimeString string
 	CPUPercent        string
 	RAMInMB           string
+	Address           string
 }
 
 func (wm *WorkerManager) logResourceUsage() {
@@ -59,26 +59,17 @@ func (wm *WorkerManager) logResourceUsage() {
 		var workerInfos []WorkerInfo
 		var maxIDLen, maxElapsedLen, maxCPULen, maxRAMLen int
 
-		for _, worker := range wm.workers {
+		for _, worker := range wm.workerList() {
 			if !worker.IsLaunched() {
 				continue
 			}
-			p, err := process.NewProcess(int32(worker.cmd.Process.Pid))
+			stats, err := worker.Stats()
 			if err != nil {
-				wm.logger.Error("Failed to get process", zap.String("workerId", string(worker.ID)), zap.Error(err))
+				wm.logger.Error("Failed to get worker stats", zap.String("workerId", string(worker.ID)), zap.Error(err))
 				continue
 			}
-			cpuPercent, err := p.CPUPercent()
-			if err != nil {
-				wm.logger.Error("Failed to get CPU usage", zap.String("workerId", string(worker.ID)), zap.Error(err))
-			}
-
-			memInfo, err := p.MemoryInfo()
-			if err != nil {
-				wm.logger.Error("Failed to get memory usage", zap.String("workerId", string(worker.ID)), zap.Error(err))
-			}
-
-			ramInMB := float64(memInfo.RSS) / (1024 * 1024)
+			cpuPercent := stats.CPUPercent
+			ramInMB := stats.RAMInMB
 
 			idLen := len(worker.ID)
 			elapsedLen := len(worker.ElapsedTimeString())
@@ -103,12 +94,13 @@ func (wm *WorkerManager) logResourceUsage() {
 				ElapsedTimeString: worker.ElapsedTimeString(),
 				CPUPercent:        fmt.Sprintf("%.2f", cpuPercent),
 				RAMInMB:           fmt.Sprintf("%.2f", ramInMB),
+				Address:           worker.Address(),
 			})
 		}
 		var formattedWorkerInfo []string
 		for _, info := range workerInfos {
-			formattedWorkerInfo = append(formattedWorkerInfo, fmt.Sprintf("⚙️ Worker %s%-*s (⏱️lifetime: %s%-*s): 🖥️ CPU: %s%-*s%% | 💾 RAM: %s%-*s MB",
-				info.ID, maxIDLen-len(info.ID), "", info.ElapsedTimeString, maxElapsedLen-len(info.ElapsedTimeString), "", info.CPUPercent, maxCPULen-len(info.CPUPercent), "", info.RAMInMB, maxRAMLen-len(info.RAMInMB), ""))
+			formattedWorkerInfo = append(formattedWorkerInfo, fmt.Sprintf("⚙️ Worker %s%-*s (⏱️lifetime: %s%-*s): 🖥️ CPU: %s%-*s%% | 💾 RAM: %s%-*s MB | 🔌 %s",
+				info.ID, maxIDLen-len(info.ID), "", info.ElapsedTimeString, maxElapsedLen-len(info.ElapsedTimeString), "", info.CPUPercent, maxCPULen-len(info.CPUPercent), "", info.RAMInMB, maxRAMLen-len(info.RAMInMB), "", info.Address))
 
 		}
 		fmt.Printf("························ 🎮 TOTAL GPU USAGE:  %.2f%% \n", gpuPercent)
@@ -120,7 +112,9 @@ func (wm *WorkerManager) logResourceUsage() {
 	}
 }
 func (w *Worker) ElapsedTimeString() string {
+	w.mu.Lock()
 	elapsedTime := time.Since(w.startTime)
+	w.mu.Unlock()
 	hours := int(elapsedTime.Hours())
 	minutes := int(elapsedTime.Minutes()) % 60
 	seconds := int(elapsedTime.Seconds()) % 60
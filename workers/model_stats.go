@@ -0,0 +1,161 @@
+package workers
+
+import (
+	"model-hub/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindow is the number of recent response times kept per model.
+	latencyWindow = 500
+	// minLatencySamples are needed before percentiles are used for decisions.
+	minLatencySamples = 20
+)
+
+// modelStats counts the predictions of one model and keeps its recent response
+// times, measured until the worker response headers arrive.
+type modelStats struct {
+	requests  int
+	errors    int
+	retries   int
+	fallbacks int // requests passed to the next model of the fallback chain
+	shadowed  int // copies sent to the shadow model
+	dropped   int // copies dropped because no shadow worker was idle
+	hedged    int // requests sent to a second worker
+	hedgeWins int // hedged requests answered first by the second worker
+	latencies []time.Duration
+	next      int
+	mu        sync.Mutex
+}
+
+func (s *modelStats) observe(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if len(s.latencies) < latencyWindow {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	s.latencies[s.next] = latency
+	s.next = (s.next + 1) % latencyWindow
+}
+
+func (s *modelStats) observeError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.errors++
+}
+
+func (s *modelStats) observeRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retries++
+}
+
+func (s *modelStats) observeFallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fallbacks++
+}
+
+func (s *modelStats) observeShadow(sent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sent {
+		s.shadowed++
+	} else {
+		s.dropped++
+	}
+}
+
+func (s *modelStats) observeHedged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hedged++
+}
+
+func (s *modelStats) observeHedgeWin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hedgeWins++
+}
+
+// percentile returns the given percentile of the recent response times. It
+// returns false until enough responses were observed.
+func (s *modelStats) percentile(p float64) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.latencies) < minLatencySamples {
+		return 0, false
+	}
+	return percentileOf(s.latencies, p), true
+}
+
+func percentileOf(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(p / 100 * float64(len(sorted)))
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+type ModelStatus struct {
+	Model       models.ModelName `json:"model"`
+	Queued      int              `json:"queued"`
+	IdleWorkers int              `json:"idle_workers"`
+	Requests    int              `json:"requests"`
+	Errors      int              `json:"errors"`
+	Retries     int              `json:"retries"`
+	Fallbacks   int              `json:"fallbacks"`
+	Hedged      int              `json:"hedged"`
+	HedgeWins   int              `json:"hedge_wins"`
+	Shadowed    int              `json:"shadowed"`
+	ShadowDrops int              `json:"shadow_dropped"`
+	LatencyP50  float64          `json:"latency_p50_ms"`
+	LatencyP95  float64          `json:"latency_p95_ms"`
+	LatencyP99  float64          `json:"latency_p99_ms"`
+	// Circuit is the circuit breaker state, empty if the model has none.
+	Circuit       string `json:"circuit,omitempty"`
+	CircuitReason string `json:"circuit_reason,omitempty"`
+	// Variants are the models of a traffic split.
+	Variants []VariantStatus `json:"variants,omitempty"`
+}
+
+func (s *modelStats) status() ModelStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	milliseconds := func(p float64) float64 {
+		return float64(percentileOf(s.latencies, p).Microseconds()) / 1000
+	}
+	return ModelStatus{
+		Requests:    s.requests,
+		Errors:      s.errors,
+		Retries:     s.retries,
+		Fallbacks:   s.fallbacks,
+		Hedged:      s.hedged,
+		HedgeWins:   s.hedgeWins,
+		Shadowed:    s.shadowed,
+		ShadowDrops: s.dropped,
+		LatencyP50:  milliseconds(50),
+		LatencyP95:  milliseconds(95),
+		LatencyP99:  milliseconds(99),
+	}
+}
@@ -0,0 +1,191 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"model-hub/config"
+	"model-hub/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pipeline sends a request through a chain of models.
+type pipeline struct {
+	name  models.ModelName
+	steps []config.PipelineStep
+	stats *modelStats
+}
+
+func newPipeline(model config.Model) *pipeline {
+	return &pipeline{name: model.Name, steps: model.Pipeline, stats: &modelStats{}}
+}
+
+// predictPipeline sends the request through the steps of the pipeline. Every
+// step is a prediction of its own, scheduled with the options of the request,
+// and the response of the last step is returned unread.
+func (wm *WorkerManager) predictPipeline(ctx context.Context, p *pipeline, options RequestOptions, body []byte) (*PredictResult, error) {
+	start := time.Now()
+	result, err := wm.runPipeline(ctx, p, options, body)
+	if err != nil {
+		if ctx.Err() == nil && !errors.Is(err, ErrTenantLimit) {
+			p.stats.observeError()
+		}
+		return nil, err
+	}
+	p.stats.observe(time.Since(start))
+	return result, nil
+}
+
+func (wm *WorkerManager) runPipeline(ctx context.Context, p *pipeline, options RequestOptions, body []byte) (*PredictResult, error) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("pipeline %s: failed to decode request body: %v", p.name, err)
+	}
+	scope := map[string]interface{}{config.RequestStep: request}
+	attempts := 0
+	for i, step := range p.steps {
+		stepBody, err := stepRequest(step, scope, request)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: step %s: %v", p.name, step.Name, err)
+		}
+		result, err := wm.Predict(ctx, step.Model, options, stepBody)
+		if err != nil {
+			var predictErr *PredictError
+			if errors.As(err, &predictErr) {
+				predictErr.Attempts += attempts
+			}
+			return nil, fmt.Errorf("pipeline %s: step %s: %w", p.name, step.Name, err)
+		}
+		attempts += result.Attempts
+		if i == len(p.steps)-1 {
+			result.Attempts = attempts
+			return result, nil
+		}
+
+		response, err := wm.stepResponse(result)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: step %s: %v", p.name, step.Name, err)
+		}
+		scope[step.Name] = response
+		scope[config.PreviousStep] = response
+	}
+	// steps are validated on load
+	return nil, fmt.Errorf("pipeline %s has no steps", p.name)
+}
+
+// stepRequest builds the request body of a step from its mapping.
+func stepRequest(step config.PipelineStep, scope map[string]interface{}, request map[string]interface{}) ([]byte, error) {
+	instances, err := resolveMapping(step.Instances, scope)
+	if err != nil {
+		return nil, err
+	}
+	parameters := make(map[string]interface{})
+	if step.Parameters == nil {
+		requestParameters, _ := request["parameters"].(map[string]interface{})
+		for name, value := range requestParameters {
+			parameters[name] = value
+		}
+	}
+	for name, value := range step.Parameters {
+		if parameters[name], err = resolveMapping(value, scope); err != nil {
+			return nil, err
+		}
+	}
+	parameters["model"] = step.Model
+	return json.Marshal(map[string]interface{}{"instances": instances, "parameters": parameters})
+}
+
+// stepResponse reads the JSON response of an intermediate step and releases its worker.
+func (wm *WorkerManager) stepResponse(result *PredictResult) (interface{}, error) {
+	data, err := io.ReadAll(result.Body)
+	result.Body.Close()
+	wm.ReleaseWorker(result.Worker.ID)
+	if err != nil {
+		return nil, fmt.Errorf("worker %s: failed to read response body: %v", result.Worker.ID, err)
+	}
+	var response interface{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("worker %s: response is not JSON: %v", result.Worker.ID, err)
+	}
+	return response, nil
+}
+
+// resolveMapping replaces the references in a step mapping with the values they refer to.
+func resolveMapping(value interface{}, scope map[string]interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		if strings.HasPrefix(value, config.ReferencePrefix+config.ReferencePrefix) {
+			return strings.TrimPrefix(value, config.ReferencePrefix), nil
+		}
+		if !strings.HasPrefix(value, config.ReferencePrefix) {
+			return value, nil
+		}
+		segments := strings.Split(strings.TrimPrefix(value, config.ReferencePrefix), ".")
+		resolved, ok := lookup(scope[segments[0]], segments[1:])
+		if !ok {
+			return nil, fmt.Errorf("no value at %s", value)
+		}
+		return resolved, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for name, item := range value {
+			resolved, err := resolveMapping(item, scope)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = resolved
+		}
+		return object, nil
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, item := range value {
+			resolved, err := resolveMapping(item, scope)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = resolved
+		}
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+// lookup follows a path of object keys and array indexes. The "*" segment
+// applies the rest of the path to every item of an array.
+func lookup(value interface{}, segments []string) (interface{}, bool) {
+	if len(segments) == 0 {
+		return value, true
+	}
+	segment, rest := segments[0], segments[1:]
+	switch value := value.(type) {
+	case map[string]interface{}:
+		item, ok := value[segment]
+		if !ok {
+			return nil, false
+		}
+		return lookup(item, rest)
+	case []interface{}:
+		if segment == "*" {
+			items := make([]interface{}, len(value))
+			for i, item := range value {
+				resolved, ok := lookup(item, rest)
+				if !ok {
+					return nil, false
+				}
+				items[i] = resolved
+			}
+			return items, true
+		}
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(value) {
+			return nil, false
+		}
+		return lookup(value[index], rest)
+	}
+	return nil, false
+}
@@ -0,0 +1,139 @@
+package workers
+
+import (
+	"encoding/json"
+	"model-hub/config"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decode parses a JSON test value.
+func decode(t *testing.T, data string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestLookup(t *testing.T) {
+	value := decode(t, `{"predictions":[{"language":"de","score":0.9},{"language":"fr","score":0.7}],"model":"detect"}`)
+	tests := []struct {
+		path string
+		want string // JSON, empty if the path does not resolve
+	}{
+		{path: "", want: `{"predictions":[{"language":"de","score":0.9},{"language":"fr","score":0.7}],"model":"detect"}`},
+		{path: "model", want: `"detect"`},
+		{path: "predictions.1.language", want: `"fr"`},
+		{path: "predictions.*.language", want: `["de","fr"]`},
+		{path: "predictions.*", want: `[{"language":"de","score":0.9},{"language":"fr","score":0.7}]`},
+		{path: "missing"},
+		{path: "predictions.2"},
+		{path: "predictions.-1"},
+		{path: "predictions.first"},
+		{path: "predictions.*.missing"},
+		{path: "model.length"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			var segments []string
+			if test.path != "" {
+				segments = strings.Split(test.path, ".")
+			}
+			got, ok := lookup(value, segments)
+			if test.want == "" {
+				if ok {
+					t.Errorf("resolved to %v, want no value", got)
+				}
+				return
+			}
+			if !ok || !reflect.DeepEqual(got, decode(t, test.want)) {
+				t.Errorf("got %v (ok %t), want %s", got, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveMapping(t *testing.T) {
+	scope := map[string]interface{}{
+		config.RequestStep:  decode(t, `{"instances":["Hallo","Bonjour"],"parameters":{"labels":["pos","neg"]}}`),
+		"detect":            decode(t, `{"predictions":[{"language":"de"},{"language":"fr"}]}`),
+		config.PreviousStep: decode(t, `{"predictions":["Hello","Hello"]}`),
+	}
+	tests := []struct {
+		name    string
+		mapping string // JSON
+		want    string // JSON, empty if resolving fails
+	}{
+		{name: "request instances", mapping: `"$request.instances"`, want: `["Hallo","Bonjour"]`},
+		{name: "previous step", mapping: `"$previous.predictions"`, want: `["Hello","Hello"]`},
+		{name: "step by name over an array", mapping: `"$detect.predictions.*.language"`, want: `["de","fr"]`},
+		{name: "whole step response", mapping: `"$detect"`, want: `{"predictions":[{"language":"de"},{"language":"fr"}]}`},
+		{name: "literal string", mapping: `"en"`, want: `"en"`},
+		{name: "escaped prefix", mapping: `"$$5 off"`, want: `"$5 off"`},
+		{name: "literal number", mapping: `3`, want: `3`},
+		{
+			name:    "nested objects and arrays",
+			mapping: `{"texts":"$request.instances","options":["$request.parameters.labels",{"target":"en"}]}`,
+			want:    `{"texts":["Hallo","Bonjour"],"options":[["pos","neg"],{"target":"en"}]}`,
+		},
+		{name: "missing value", mapping: `"$request.parameters.threshold"`},
+		{name: "unknown step", mapping: `"$translate.predictions"`},
+		{name: "missing value in a nested mapping", mapping: `{"texts":["$detect.predictions.5"]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveMapping(decode(t, test.mapping), scope)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("resolved to %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, decode(t, test.want)) {
+				t.Errorf("got %v, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStepRequest(t *testing.T) {
+	request := decode(t, `{"instances":["Hallo"],"parameters":{"model":"pipe","labels":["pos","neg"]}}`).(map[string]interface{})
+	scope := map[string]interface{}{config.RequestStep: request}
+	tests := []struct {
+		name string
+		step config.PipelineStep
+		want string
+	}{
+		{
+			name: "request parameters by default",
+			step: config.PipelineStep{Model: "detect", Instances: "$request.instances"},
+			want: `{"instances":["Hallo"],"parameters":{"model":"detect","labels":["pos","neg"]}}`,
+		},
+		{
+			name: "mapped parameters only",
+			step: config.PipelineStep{
+				Model:      "translate",
+				Instances:  "$request.instances",
+				Parameters: map[string]interface{}{"target": "en"},
+			},
+			want: `{"instances":["Hallo"],"parameters":{"model":"translate","target":"en"}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := stepRequest(test.step, scope, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decode(t, string(body)); !reflect.DeepEqual(got, decode(t, test.want)) {
+				t.Errorf("got %s, want %s", body, test.want)
+			}
+		})
+	}
+}
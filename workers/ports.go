@@ -0,0 +1,88 @@
+package workers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// portAllocator hands out free TCP ports to local workers, either from the
+// configured range or from the ports chosen by the OS.
+type portAllocator struct {
+	min   int
+	max   int
+	inUse map[int]bool
+	mu    sync.Mutex
+}
+
+// newPortAllocator parses a range such as "8000-8100". An empty range lets the OS pick ports.
+func newPortAllocator(portRange string) (*portAllocator, error) {
+	allocator := &portAllocator{inUse: make(map[int]bool)}
+	if portRange == "" {
+		return allocator, nil
+	}
+
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid port range %q", portRange)
+	}
+	var err error
+	if allocator.min, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", portRange, err)
+	}
+	if allocator.max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", portRange, err)
+	}
+	if allocator.min <= 0 || allocator.max > 65535 || allocator.min > allocator.max {
+		return nil, fmt.Errorf("invalid port range %q", portRange)
+	}
+	return allocator, nil
+}
+
+// Acquire returns a port that is currently free and not assigned to another worker.
+func (pa *portAllocator) Acquire() (int, error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	if pa.max == 0 {
+		for attempt := 0; attempt < 10; attempt++ {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return 0, err
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+			if !pa.inUse[port] {
+				pa.inUse[port] = true
+				return port, nil
+			}
+		}
+		return 0, fmt.Errorf("failed to find a free port")
+	}
+
+	for port := pa.min; port <= pa.max; port++ {
+		if !pa.inUse[port] && portFree(port) {
+			pa.inUse[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d", pa.min, pa.max)
+}
+
+func (pa *portAllocator) Release(port int) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	delete(pa.inUse, port)
+}
+
+func portFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
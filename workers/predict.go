@@ -0,0 +1,300 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"model-hub/config"
+	"model-hub/models"
+	"time"
+)
+
+// ErrWaitTimeout is returned when a request waited longer than its MaxWait for a worker.
+var ErrWaitTimeout = errors.New("timed out waiting for a worker")
+
+// PredictResult is a successful prediction and the worker that made it. The
+// caller must close the body and then release the worker.
+type PredictResult struct {
+	*Prediction
+	Worker   *Worker
+	Model    models.ModelName // the model that served the request, differs from the requested one after a fallback
+	Variant  models.ModelName // the variant chosen by a traffic split
+	Attempts int
+}
+
+// PredictError is a failed prediction and the number of attempts that were made.
+type PredictError struct {
+	Attempts int
+	Variant  models.ModelName
+	Err      error
+}
+
+func (e *PredictError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PredictError) Unwrap() error {
+	return e.Err
+}
+
+// Predict waits for a worker of the model and forwards the raw request body to
+// it. The model may be named by a version or an alias. Requests to a traffic
+// split, or to an alias with a running canary, are sent to one of its variants,
+// requests to a pipeline through its steps.
+func (wm *WorkerManager) Predict(ctx context.Context, modelName models.ModelName, options RequestOptions, body []byte) (*PredictResult, error) {
+	if options.Tenant == "" {
+		options.Tenant = config.DefaultTenant
+	}
+	split, ok := wm.canarySplit(modelName)
+	if !ok {
+		modelName = wm.resolve(modelName)
+		if p, isPipeline := wm.pipelines[modelName]; isPipeline {
+			return wm.predictPipeline(ctx, p, options, body)
+		}
+		split, ok = wm.splits[modelName]
+	}
+	if !ok {
+		return wm.predictChain(ctx, modelName, options, body)
+	}
+
+	variant := split.choose(options.RoutingKey)
+	stats := split.stats[variant]
+	start := time.Now()
+	result, err := wm.predictChain(ctx, wm.resolve(variant), options, body)
+	if err != nil {
+		if ctx.Err() == nil && !errors.Is(err, ErrTenantLimit) {
+			stats.observeError()
+		}
+		var predictErr *PredictError
+		if errors.As(err, &predictErr) {
+			predictErr.Variant = variant
+		}
+		return nil, err
+	}
+	stats.observe(time.Since(start))
+	result.Variant = variant
+	return result, nil
+}
+
+// predictChain sends the request to the model. If the model can not serve the
+// request, it is passed down the model's fallback chain.
+func (wm *WorkerManager) predictChain(ctx context.Context, modelName models.ModelName, options RequestOptions, body []byte) (*PredictResult, error) {
+	model, _ := wm.modelConfig(modelName)
+	start := time.Now()
+	shadow := wm.startShadow(model, body)
+	chain := append([]models.ModelName{modelName}, model.Fallback...)
+	attempts := 0
+	var err error
+	for i, name := range chain {
+		name = wm.resolve(name)
+		modelOptions := options
+		if i < len(chain)-1 {
+			modelOptions.MaxWait = model.FallbackAfter
+		}
+		var result *PredictResult
+		result, err = wm.predictModel(ctx, name, modelOptions, body)
+		var predictErr *PredictError
+		if errors.As(err, &predictErr) {
+			attempts += predictErr.Attempts
+			predictErr.Attempts = attempts
+		}
+		if err == nil {
+			result.Attempts += attempts
+			if shadow != nil {
+				result.Body = &recordingBody{ReadCloser: result.Body, start: start, primary: shadow}
+			}
+			return result, nil
+		}
+		if i == len(chain)-1 || errors.Is(err, ErrTenantLimit) || ctx.Err() != nil {
+			break
+		}
+		wm.stats[modelName].observeFallback()
+		wm.logger.Warn(fmt.Sprintf("Model %s: falling back to model %s: %v", name, wm.resolve(chain[i+1]), err))
+	}
+	if shadow != nil {
+		shadow <- shadowOutcome{err: err, latency: time.Since(start)}
+	}
+	return nil, err
+}
+
+// predictModel sends the request to a worker of the model. Requests are
+// rejected with a CircuitOpenError while the circuit breaker of the model is open.
+func (wm *WorkerManager) predictModel(ctx context.Context, modelName models.ModelName, options RequestOptions, body []byte) (*PredictResult, error) {
+	breaker, ok := wm.breakers[modelName]
+	if !ok {
+		return wm.predictWithRetries(ctx, modelName, options, body)
+	}
+	probe, err := breaker.allow()
+	if err != nil {
+		return nil, &PredictError{Err: err}
+	}
+	result, err := wm.predictWithRetries(ctx, modelName, options, body)
+	if err != nil && (errors.Is(err, ErrTenantLimit) || errors.Is(err, ErrWaitTimeout) || ctx.Err() != nil) {
+		// says nothing about the health of the model
+		breaker.abandon(probe)
+	} else {
+		breaker.record(probe, err != nil)
+	}
+	return result, err
+}
+
+// predictWithRetries retries requests that failed to reach their worker on
+// another worker, as often as the model allows.
+func (wm *WorkerManager) predictWithRetries(ctx context.Context, modelName models.ModelName, options RequestOptions, body []byte) (*PredictResult, error) {
+	retries := 0
+	if model, ok := wm.modelConfig(modelName); ok && model.Retries != nil {
+		retries = *model.Retries
+	}
+	for attempts := 1; ; attempts++ {
+		result, err := wm.predictOnce(ctx, modelName, options, body)
+		if err == nil {
+			result.Model = modelName
+			result.Attempts = attempts
+			return result, nil
+		}
+		// a request that reached its worker may have been handled, even if the
+		// connection broke before the response
+		var transportErr *TransportError
+		if !errors.As(err, &transportErr) || !transportErr.Dial || attempts > retries || ctx.Err() != nil {
+			return nil, &PredictError{Attempts: attempts, Err: err}
+		}
+		wm.stats[modelName].observeRetry()
+		wm.logger.Warn(fmt.Sprintf("Model %s: retrying the request on another worker (attempt %d): %v", modelName, attempts+1, err))
+	}
+}
+
+// predictOnce sends the request to a single worker. With hedging enabled, a
+// request that is slow to get a response is also sent to a second idle worker
+// and the first successful response is returned.
+func (wm *WorkerManager) predictOnce(ctx context.Context, modelName models.ModelName, options RequestOptions, body []byte) (*PredictResult, error) {
+	acquireCtx := ctx
+	if options.MaxWait > 0 {
+		var cancel context.CancelFunc
+		acquireCtx, cancel = context.WithTimeout(ctx, options.MaxWait)
+		defer cancel()
+	}
+	worker, err := wm.GetAvailableWorker(acquireCtx, modelName, options)
+	if err != nil {
+		if acquireCtx.Err() != nil && ctx.Err() == nil {
+			return nil, fmt.Errorf("model %s: %w after %s", modelName, ErrWaitTimeout, options.MaxWait)
+		}
+		return nil, fmt.Errorf("failed to get available worker: %w", err)
+	}
+	model, _ := wm.modelConfig(modelName)
+	if model.Hedge != nil {
+		return wm.predictHedged(ctx, model, options, worker, body)
+	}
+
+	stats := wm.stats[modelName]
+	start := time.Now()
+	prediction, err := worker.Predict(ctx, body)
+	if err != nil {
+		stats.observeError()
+		wm.ReleaseWorker(worker.ID)
+		return nil, err
+	}
+	stats.observe(time.Since(start))
+	return &PredictResult{Prediction: prediction, Worker: worker}, nil
+}
+
+type attempt struct {
+	worker     *Worker
+	prediction *Prediction
+	err        error
+	latency    time.Duration
+}
+
+// predictHedged sends the request to the worker, and to a second idle worker if
+// no response arrived within the hedge delay. The call that loses is cancelled.
+func (wm *WorkerManager) predictHedged(ctx context.Context, model config.Model, options RequestOptions, worker *Worker, body []byte) (*PredictResult, error) {
+	stats := wm.stats[model.Name]
+	results := make(chan attempt, 2)
+	cancels := make(map[WorkerId]context.CancelFunc)
+	send := func(worker *Worker) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[worker.ID] = cancel
+		go func() {
+			start := time.Now()
+			prediction, err := worker.Predict(attemptCtx, body)
+			results <- attempt{worker: worker, prediction: prediction, err: err, latency: time.Since(start)}
+		}()
+	}
+	send(worker)
+	pending := 1
+
+	// no hedging until the model has a latency history
+	var hedgeTimer <-chan time.Time
+	delay, ok := stats.percentile(model.Hedge.Percentile)
+	if ok {
+		if delay < model.Hedge.MinDelay {
+			delay = model.Hedge.MinDelay
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+
+	var hedge *Worker
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			hedge = wm.dispatchers[model.Name].tryAcquire(NewWorkerRequest(options))
+			if hedge == nil {
+				continue
+			}
+			stats.observeHedged()
+			wm.logger.Info(fmt.Sprintf("Model %s: no response from worker %s after %s, hedging to worker %s",
+				model.Name, worker.ID, delay.Round(time.Millisecond), hedge.ID))
+			send(hedge)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				cancels[result.worker.ID]()
+				wm.ReleaseWorker(result.worker.ID)
+				lastErr = result.err
+				continue
+			}
+			stats.observe(result.latency)
+			if result.worker == hedge {
+				stats.observeHedgeWin()
+			}
+			if pending > 0 {
+				for id, cancel := range cancels {
+					if id != result.worker.ID {
+						cancel()
+					}
+				}
+				go wm.discard(results)
+			}
+			result.prediction.Body = cancelBody{ReadCloser: result.prediction.Body, cancel: cancels[result.worker.ID]}
+			return &PredictResult{Prediction: result.prediction, Worker: result.worker}, nil
+		}
+	}
+	stats.observeError()
+	return nil, lastErr
+}
+
+// discard waits for a cancelled attempt and releases its worker.
+func (wm *WorkerManager) discard(results chan attempt) {
+	result := <-results
+	if result.prediction != nil {
+		result.prediction.Body.Close()
+	}
+	wm.ReleaseWorker(result.worker.ID)
+}
+
+// cancelBody ends the call of a prediction once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
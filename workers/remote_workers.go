@@ -0,0 +1,124 @@
+package workers
+
+import (
+	"fmt"
+	"model-hub/config"
+	"model-hub/models"
+	"strings"
+	"time"
+)
+
+// RegisterRemoteWorker adds a remote endpoint as a worker of the model or, if the
+// endpoint is already registered, records a heartbeat for it.
+func (wm *WorkerManager) RegisterRemoteWorker(modelName models.ModelName, endpoint string) (WorkerId, error) {
+	model, ok := wm.modelConfig(modelName)
+	if !ok {
+		return "", fmt.Errorf("unknown model: %s", modelName)
+	}
+	if model.Runtime != config.RuntimeRemote {
+		return "", fmt.Errorf("model %s does not accept remote workers", modelName)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if endpoint == "" {
+		return "", fmt.Errorf("endpoint is required")
+	}
+
+	wm.workersMu.Lock()
+	registered := 0
+	for _, worker := range wm.workers {
+		if worker.Model.Name != modelName || !worker.Registered {
+			continue
+		}
+		if worker.Endpoint == endpoint {
+			wm.workersMu.Unlock()
+			worker.Heartbeat()
+			return worker.ID, nil
+		}
+		registered++
+	}
+	if registered >= model.MaxRegistered {
+		wm.workersMu.Unlock()
+		return "", fmt.Errorf("model %s already has %d registered workers", modelName, registered)
+	}
+
+	wm.registeredSeq++
+	workerID := WorkerId(fmt.Sprintf("%s-remote-%d", modelName, wm.registeredSeq))
+	worker := NewWorker(workerID, model, endpoint, nil, wm.failedWorkerChan, wm.readyWorkerChan, wm.logger)
+	worker.Registered = true
+	worker.Heartbeat()
+	wm.workers[workerID] = worker
+	wm.workersMu.Unlock()
+
+	wm.logger.Info(fmt.Sprintf("Worker %s: registered remote endpoint %s", workerID, endpoint))
+	worker.Start()
+	return workerID, nil
+}
+
+func (wm *WorkerManager) removeWorker(worker *Worker) {
+	wm.workersMu.Lock()
+	delete(wm.workers, worker.ID)
+	wm.workersMu.Unlock()
+
+	worker.Retire()
+	wm.dispatchers[worker.Model.Name].drop(worker)
+	worker.Stop()
+	worker.Close()
+}
+
+// monitorRemoteWorkers health checks remote workers. Unreachable workers stop
+// receiving requests until they answer again, registered workers without a
+// recent heartbeat are removed.
+func (wm *WorkerManager) monitorRemoteWorkers() {
+	interval := time.Duration(0)
+	wm.modelsMu.RLock()
+	for _, model := range wm.models {
+		if model.Runtime == config.RuntimeRemote && (interval == 0 || model.HealthCheckInterval < interval) {
+			interval = model.HealthCheckInterval
+		}
+	}
+	wm.modelsMu.RUnlock()
+	if interval == 0 {
+		return
+	}
+
+	lastCheck := make(map[WorkerId]time.Time)
+	for {
+		time.Sleep(interval)
+		for _, worker := range wm.workerList() {
+			if worker.Model.Runtime != config.RuntimeRemote || !worker.IsLaunched() {
+				continue
+			}
+			if worker.HeartbeatExpired(worker.Model.HeartbeatTimeout) {
+				wm.logger.Warn(fmt.Sprintf("Worker %s: heartbeat expired, removing", worker.ID))
+				wm.removeWorker(worker)
+				delete(lastCheck, worker.ID)
+				continue
+			}
+			if time.Since(lastCheck[worker.ID]) < worker.Model.HealthCheckInterval {
+				continue
+			}
+			lastCheck[worker.ID] = time.Now()
+			go wm.checkRemoteWorker(worker)
+		}
+	}
+}
+
+func (wm *WorkerManager) checkRemoteWorker(worker *Worker) {
+	err := worker.Health()
+	loaded := worker.IsLoaded()
+	switch {
+	case err != nil && loaded:
+		wm.logger.Warn(fmt.Sprintf("Worker %s: health check failed, removing from scheduling: %v", worker.ID, err))
+		worker.SetUnLoaded()
+		wm.dispatchers[worker.Model.Name].remove(worker)
+	case err == nil && !loaded:
+		wm.logger.Info(fmt.Sprintf("Worker %s: endpoint is reachable again", worker.ID))
+		if worker.IsBusy() {
+			// the in-flight request puts the worker back when it completes
+			worker.SetLoaded()
+		} else {
+			// warmed up again before it takes traffic, the endpoint may have restarted
+			wm.WorkerReady(worker.ID)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package workers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecoveredRemoteWorkerIsWarmedUp(t *testing.T) {
+	var down atomic.Bool
+	var predictions atomic.Int64
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/predict" {
+			predictions.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"predictions":[]}`))
+	}))
+	defer endpoint.Close()
+
+	wm := startTestManager(t, fmt.Sprintf(`
+models:
+  m:
+    name: "m"
+    runtime: "remote"
+    endpoints: ["%s"]
+    warmup:
+      samples:
+        - instances: [1]
+        - instances: [2]
+`, endpoint.URL))
+	if warmups := predictions.Load(); warmups != 2 {
+		t.Fatalf("%d warmup requests on start, want 2", warmups)
+	}
+	worker, _ := wm.getWorker("m-1")
+
+	down.Store(true)
+	wm.checkRemoteWorker(worker)
+	if _, idle := wm.dispatchers["m"].stats(); idle != 0 {
+		t.Fatal("unreachable worker still handed out")
+	}
+
+	down.Store(false)
+	// checked again while the warmup of the first check may still run
+	wm.checkRemoteWorker(worker)
+	wm.checkRemoteWorker(worker)
+	waitForIdleWorkers(t, wm, "m", 1)
+	if warmups := predictions.Load(); warmups != 4 {
+		t.Errorf("%d warmup requests after recovery, want 2 more", warmups-2)
+	}
+}
@@ -0,0 +1,193 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"model-hub/config"
+	"model-hub/models"
+	"time"
+)
+
+const (
+	RolloutRunning    = "running"
+	RolloutCompleted  = "completed"
+	RolloutRolledBack = "rolled_back"
+
+	// defaultRolloutTimeout is how long new workers may take to load by default.
+	defaultRolloutTimeout = 5 * time.Minute
+)
+
+// RolloutOptions describe a rolling update of the workers of a model.
+type RolloutOptions struct {
+	Path    string
+	Handler string
+	// Timeout for the new workers to load and warm up, and for the old ones to drain.
+	Timeout time.Duration
+	// Warmup are request bodies sent to every new worker before the switch, in
+	// addition to the warmup requests of the model.
+	Warmup []json.RawMessage
+}
+
+type RolloutStatus struct {
+	Model    models.ModelName `json:"model"`
+	State    string           `json:"state"`
+	Reason   string           `json:"reason,omitempty"`
+	Path     string           `json:"path"`
+	Handler  string           `json:"handler"`
+	Workers  []WorkerId       `json:"workers"`
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+}
+
+// StartRollout replaces the workers of a model with workers using a new path or
+// handler, without downtime. The new workers are started next to the old ones
+// and take over all at once when all of them are loaded, then the old workers
+// finish their requests and are stopped. If the new workers do not load in
+// time, they are stopped and the old ones keep serving.
+func (wm *WorkerManager) StartRollout(modelName models.ModelName, options RolloutOptions) (RolloutStatus, error) {
+	modelName = wm.resolve(modelName)
+	if options.Path == "" && options.Handler == "" {
+		return RolloutStatus{}, fmt.Errorf("a rollout requires a new path or handler")
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultRolloutTimeout
+	}
+
+	wm.modelsMu.Lock()
+	defer wm.modelsMu.Unlock()
+
+	model, ok := wm.models[modelName]
+	if !ok || len(model.Split) > 0 || len(model.Pipeline) > 0 {
+		return RolloutStatus{}, fmt.Errorf("unknown model: %s", modelName)
+	}
+	if model.Runtime != config.RuntimePython && model.Runtime != config.RuntimeCommand {
+		return RolloutStatus{}, fmt.Errorf("model %s: rollouts are only supported by local runtimes", modelName)
+	}
+	if previous, ok := wm.rollouts[modelName]; ok && previous.State == RolloutRunning {
+		return RolloutStatus{}, fmt.Errorf("model %s: a rollout is already running", modelName)
+	}
+
+	if options.Path != "" {
+		model.Path = options.Path
+	}
+	if options.Handler != "" {
+		model.Handler = options.Handler
+	}
+	status := &RolloutStatus{
+		Model:   modelName,
+		State:   RolloutRunning,
+		Path:    model.Path,
+		Handler: model.Handler,
+		Started: time.Now(),
+	}
+	wm.rollouts[modelName] = status
+	go wm.rollout(model, options, status)
+	return *status, nil
+}
+
+// Rollout returns the state of the last rollout of the model.
+func (wm *WorkerManager) Rollout(modelName models.ModelName) (RolloutStatus, bool) {
+	wm.modelsMu.RLock()
+	defer wm.modelsMu.RUnlock()
+
+	status, ok := wm.rollouts[wm.resolve(modelName)]
+	if !ok {
+		return RolloutStatus{}, false
+	}
+	return *status, true
+}
+
+func (wm *WorkerManager) rollout(model config.Model, options RolloutOptions, status *RolloutStatus) {
+	var old []*Worker
+	for _, worker := range wm.workerList() {
+		if worker.Model.Name == model.Name && !worker.isStandby() && !worker.IsRetired() {
+			old = append(old, worker)
+		}
+	}
+
+	wm.workersMu.Lock()
+	var started []*Worker
+	var ids []WorkerId
+	for i := 0; i < model.Workers; i++ {
+		wm.workerSeq[model.Name]++
+		workerID := WorkerId(fmt.Sprintf("%s-%d", model.Name, wm.workerSeq[model.Name]))
+		worker := NewWorker(workerID, model, "", wm.ports, wm.failedWorkerChan, wm.readyWorkerChan, wm.logger)
+		worker.standby = true
+		wm.workers[workerID] = worker
+		started = append(started, worker)
+		ids = append(ids, workerID)
+	}
+	wm.workersMu.Unlock()
+	wm.modelsMu.Lock()
+	status.Workers = ids
+	wm.modelsMu.Unlock()
+
+	wm.logger.Info(fmt.Sprintf("Model %s: rollout of path %s and handler %s started with workers %v", model.Name, model.Path, model.Handler, ids))
+	if err := wm.prepareRollout(started, options); err != nil {
+		for _, worker := range started {
+			wm.removeWorker(worker)
+		}
+		wm.finishRollout(status, RolloutRolledBack, err.Error())
+		return
+	}
+
+	wm.modelsMu.Lock()
+	wm.models[model.Name] = model
+	wm.modelsMu.Unlock()
+	wm.dispatchers[model.Name].swap(old, started)
+	wm.logger.Info(fmt.Sprintf("Model %s: switched to workers %v, draining %d old workers", model.Name, ids, len(old)))
+
+	deadline := time.Now().Add(options.Timeout)
+	for _, worker := range old {
+		for worker.IsBusy() && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		wm.removeWorker(worker)
+	}
+	wm.finishRollout(status, RolloutCompleted, "")
+}
+
+// prepareRollout starts the new workers and waits until they are loaded, which
+// includes the warmup requests of the model, then sends the rollout warmup requests.
+func (wm *WorkerManager) prepareRollout(workers []*Worker, options RolloutOptions) error {
+	for _, worker := range workers {
+		if err := worker.start(); err != nil {
+			return fmt.Errorf("failed to start worker %s: %v", worker.ID, err)
+		}
+	}
+
+	deadline := time.Now().Add(options.Timeout)
+	for _, worker := range workers {
+		for !worker.IsLoaded() {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("worker %s did not load within %s", worker.ID, options.Timeout)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for _, worker := range workers {
+		if err := worker.warmUp(ctx, options.Warmup); err != nil {
+			return fmt.Errorf("warmup of worker %s failed: %v", worker.ID, err)
+		}
+	}
+	return nil
+}
+
+func (wm *WorkerManager) finishRollout(status *RolloutStatus, state string, reason string) {
+	wm.modelsMu.Lock()
+	defer wm.modelsMu.Unlock()
+
+	finished := time.Now()
+	status.State = state
+	status.Reason = reason
+	status.Finished = &finished
+	if state == RolloutRolledBack {
+		wm.logger.Warn(fmt.Sprintf("Model %s: rollout rolled back: %s", status.Model, reason))
+	} else {
+		wm.logger.Info(fmt.Sprintf("Model %s: rollout completed", status.Model))
+	}
+}
@@ -0,0 +1,156 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"model-hub/config"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Runtime is the backend that serves predictions for a single worker.
+type Runtime interface {
+	Start() error
+	Stop() error
+	// Predict serves a request. Cancelling ctx abandons the call.
+	Predict(ctx context.Context, body []byte) (*Prediction, error)
+	Health() error
+	Stats() (RuntimeStats, error)
+	// Address is where the runtime serves predictions, for status output.
+	Address() string
+	// Close releases what the runtime keeps across restarts, after its final Stop.
+	Close()
+}
+
+type RuntimeStats struct {
+	CPUPercent float64
+	RAMInMB    float64
+}
+
+// RuntimeEvents is used by runtimes to report lifecycle changes to their worker.
+type RuntimeEvents struct {
+	// Ready is called when the runtime can serve predictions without an explicit
+	// /model-ready notification.
+	Ready func()
+	// Exited is called when the runtime stopped unexpectedly.
+	Exited func(err error)
+	// Reassigned is called when the runtime had to move to a new address.
+	Reassigned func(reason string)
+}
+
+func newRuntime(id WorkerId, model config.Model, endpoint string, ports *portAllocator, events RuntimeEvents, logger *zap.Logger) Runtime {
+	switch model.Runtime {
+	case config.RuntimeFunction:
+		return newFunctionRuntime(id, model.Function, events)
+	case config.RuntimeRemote:
+		return newRemoteRuntime(id, model, endpoint, events, logger)
+	default:
+		return newProcessRuntime(id, model, ports, events)
+	}
+}
+
+// TransportError means the worker could not be reached or the connection broke
+// before a response was received. It is treated as a worker fault. Timeouts are
+// not transport errors: a slow prediction says nothing about the worker health.
+type TransportError struct {
+	WorkerID WorkerId
+	Err      error
+	// Dial is true if no connection to the worker could be established, so the
+	// request never reached it.
+	Dial bool
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("worker %s: failed to send POST request: %v", e.WorkerID, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// newHTTPClient creates the long-lived client used for all calls to one worker.
+// dial overrides the address from the request URL, e.g. to reach a unix socket.
+func newHTTPClient(model config.Model, dial func(ctx context.Context, dialer *net.Dialer) (net.Conn, error)) *http.Client {
+	dialer := &net.Dialer{Timeout: model.DialTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dial != nil {
+				return dial(ctx, dialer)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		MaxIdleConns:          4,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: model.ResponseHeaderTimeout,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// drainingBody reads what is left of the response before closing it, so the
+// connection can be reused for the next request.
+type drainingBody struct {
+	io.ReadCloser
+}
+
+func (b drainingBody) Close() error {
+	_, _ = io.Copy(io.Discard, io.LimitReader(b.ReadCloser, 1<<20))
+	return b.ReadCloser.Close()
+}
+
+// Prediction is a successful worker response. The caller must close Body.
+type Prediction struct {
+	ContentType   string
+	ContentLength int64 // -1 if unknown
+	Body          io.ReadCloser
+}
+
+// postPredict sends the raw request body to a worker speaking the HTTP worker contract.
+func postPredict(ctx context.Context, client *http.Client, id WorkerId, url string, body []byte) (*Prediction, error) {
+	// Create the POST request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("worker %s: failed to create POST request: %v", id, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Send the request
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// abandoned by the caller, not a worker fault
+			return nil, fmt.Errorf("worker %s: request cancelled: %w", id, ctx.Err())
+		}
+		var opErr *net.OpError
+		dial := errors.As(err, &opErr) && opErr.Op == "dial"
+		var netErr net.Error
+		if !dial && errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("worker %s: request timed out: %w", id, err)
+		}
+		return nil, &TransportError{WorkerID: id, Err: err, Dial: dial}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("worker %s: failed to read response body: %v", id, err)
+		}
+		return nil, errors.New(string(respBody))
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return &Prediction{
+		ContentType:   contentType,
+		ContentLength: resp.ContentLength,
+		Body:          drainingBody{resp.Body},
+	}, nil
+}
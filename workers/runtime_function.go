@@ -0,0 +1,100 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"model-hub/models"
+	"sync"
+)
+
+// PredictFunc serves predictions in-process for models with the function runtime.
+type PredictFunc func(request models.PredictRequest) (interface{}, error)
+
+var (
+	functions   = make(map[string]PredictFunc)
+	functionsMu sync.RWMutex
+)
+
+// RegisterFunction makes fn available to models configured with `runtime: function`
+// and `function: <name>`. It must be called before the WorkerManager is initialized.
+func RegisterFunction(name string, fn PredictFunc) {
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	functions[name] = fn
+}
+
+// functionRuntime calls a registered Go function inside the hub process.
+type functionRuntime struct {
+	id     WorkerId
+	name   string
+	fn     PredictFunc // set on every start, read by predictions in flight
+	events RuntimeEvents
+	mu     sync.Mutex
+}
+
+func newFunctionRuntime(id WorkerId, name string, events RuntimeEvents) *functionRuntime {
+	return &functionRuntime{id: id, name: name, events: events}
+}
+
+func (r *functionRuntime) Start() error {
+	functionsMu.RLock()
+	fn, ok := functions[r.name]
+	functionsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("function %s is not registered", r.name)
+	}
+	r.mu.Lock()
+	r.fn = fn
+	r.mu.Unlock()
+	go r.events.Ready()
+	return nil
+}
+
+func (r *functionRuntime) Stop() error {
+	return nil
+}
+
+// Predict runs the function to completion, a Go function can not be abandoned.
+func (r *functionRuntime) Predict(_ context.Context, body []byte) (*Prediction, error) {
+	r.mu.Lock()
+	fn := r.fn
+	r.mu.Unlock()
+	if fn == nil {
+		return nil, fmt.Errorf("worker %s: function %s is not started", r.id, r.name)
+	}
+	var request models.PredictRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("worker %s: failed to unmarshal request: %v", r.id, err)
+	}
+	response, err := fn(request)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("worker %s: failed to marshal response: %v", r.id, err)
+	}
+	return &Prediction{
+		ContentType:   "application/json",
+		ContentLength: int64(len(respBody)),
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+	}, nil
+}
+
+func (r *functionRuntime) Close() {}
+
+func (r *functionRuntime) Health() error {
+	return nil
+}
+
+func (r *functionRuntime) Stats() (RuntimeStats, error) {
+	return RuntimeStats{}, nil
+}
+
+func (r *functionRuntime) Address() string {
+	return "function:" + r.name
+}
@@ -0,0 +1,288 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shirou/gopsutil/v3/process"
+	"model-hub/config"
+	"model-hub/helper"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processRuntime runs the worker as a local subprocess: worker.py for Python
+// models or the configured command for the command runtime.
+type processRuntime struct {
+	id       WorkerId
+	model    config.Model
+	port     int
+	ports    *portAllocator
+	socket   string // socket path when the model uses the unix transport
+	client   *http.Client
+	cmd      *exec.Cmd
+	stopping bool
+	exited   bool // the current process has exited
+	mu       sync.Mutex
+	events   RuntimeEvents
+}
+
+func newProcessRuntime(id WorkerId, model config.Model, ports *portAllocator, events RuntimeEvents) *processRuntime {
+	r := &processRuntime{
+		id:     id,
+		model:  model,
+		ports:  ports,
+		events: events,
+	}
+	if model.Transport == config.TransportUnix {
+		r.client = newHTTPClient(model, func(ctx context.Context, dialer *net.Dialer) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", r.socket)
+		})
+	} else {
+		r.client = newHTTPClient(model, nil)
+	}
+	return r
+}
+
+func (r *processRuntime) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.model.Transport == config.TransportUnix && r.socket == "" {
+		dir, err := runtimeDir()
+		if err != nil {
+			return err
+		}
+		r.socket = filepath.Join(dir, string(r.id)+".sock")
+	}
+	if r.model.Transport == config.TransportTCP {
+		if err := r.assignPort(); err != nil {
+			return err
+		}
+	}
+
+	cmd := r.command()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	r.cmd = cmd
+	r.stopping = false
+	r.exited = false
+	// connections to the previous process are dead
+	r.client.CloseIdleConnections()
+
+	go func() {
+		err := cmd.Wait()
+		r.mu.Lock()
+		stopping := r.stopping
+		if r.cmd == cmd {
+			r.exited = true
+		}
+		r.mu.Unlock()
+		if err != nil && !stopping {
+			r.events.Exited(err)
+		}
+	}()
+
+	return nil
+}
+
+func (r *processRuntime) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cmd == nil || r.exited {
+		return nil
+	}
+	r.stopping = true
+	// the process may have exited before its exit was noted
+	if err := r.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+func (r *processRuntime) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.client.CloseIdleConnections()
+	if r.port != 0 {
+		r.ports.Release(r.port)
+		r.port = 0
+	}
+	if r.socket != "" {
+		_ = os.Remove(r.socket)
+	}
+}
+
+// assignPort picks a port for the next start. The port of a previous run is kept
+// unless something else took it, e.g. when the worker failed with address in use.
+func (r *processRuntime) assignPort() error {
+	if r.port != 0 {
+		if portFree(r.port) {
+			return nil
+		}
+		r.ports.Release(r.port)
+		previous := r.port
+		r.port = 0
+		port, err := r.ports.Acquire()
+		if err != nil {
+			return err
+		}
+		r.port = port
+		r.events.Reassigned(fmt.Sprintf("port %d is in use, reassigned to %d", previous, port))
+		return nil
+	}
+
+	port, err := r.ports.Acquire()
+	if err != nil {
+		return err
+	}
+	r.port = port
+	return nil
+}
+
+// command builds the process for the worker according to the model runtime.
+// Any executable can serve as a worker as long as it answers POST /predict on
+// the given port or socket and reports readiness to the hub's /model-ready endpoint.
+func (r *processRuntime) command() *exec.Cmd {
+	port := strconv.Itoa(r.port)
+	if r.model.Runtime != config.RuntimeCommand {
+		args := []string{"worker.py", string(r.id), r.model.Path, port, r.model.Handler}
+		if r.socket != "" {
+			args = append(args, "--socket", r.socket)
+		}
+		return exec.Command("python3", args...)
+	}
+
+	replacer := strings.NewReplacer(
+		"{worker_id}", string(r.id),
+		"{model}", string(r.model.Name),
+		"{path}", r.model.Path,
+		"{handler}", r.model.Handler,
+		"{port}", port,
+		"{socket}", r.socket,
+		"{server_port}", helper.GetEnv("SERVER_PORT", "7766"),
+	)
+	args := make([]string, len(r.model.Command))
+	for i, arg := range r.model.Command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"WORKER_ID="+string(r.id),
+		"WORKER_PORT="+port,
+		"WORKER_SOCKET="+r.socket,
+		"MODEL_NAME="+string(r.model.Name),
+		"MODEL_PATH="+r.model.Path,
+		"MODEL_HANDLER="+r.model.Handler,
+	)
+	return cmd
+}
+
+func (r *processRuntime) Predict(ctx context.Context, body []byte) (*Prediction, error) {
+	if r.model.Transport == config.TransportUnix {
+		// the host is ignored, the transport always dials the worker socket
+		return postPredict(ctx, r.client, r.id, "http://unix/predict", body)
+	}
+	url := fmt.Sprintf("http://%s/predict", r.Address())
+	return postPredict(ctx, r.client, r.id, url, body)
+}
+
+func (r *processRuntime) Address() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.socket != "" {
+		return "unix:" + r.socket
+	}
+	return fmt.Sprintf("127.0.0.1:%d", r.port)
+}
+
+func (r *processRuntime) Health() error {
+	pid, err := r.pid()
+	if err != nil {
+		return err
+	}
+	if _, err = process.NewProcess(int32(pid)); err != nil {
+		return err
+	}
+	network, address := "tcp", r.Address()
+	if r.socket != "" {
+		network, address = "unix", r.socket
+	}
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (r *processRuntime) Stats() (RuntimeStats, error) {
+	var stats RuntimeStats
+	pid, err := r.pid()
+	if err != nil {
+		return stats, err
+	}
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return stats, fmt.Errorf("failed to get process: %v", err)
+	}
+	stats.CPUPercent, err = p.CPUPercent()
+	if err != nil {
+		return stats, fmt.Errorf("failed to get CPU usage: %v", err)
+	}
+	memInfo, err := p.MemoryInfo()
+	if err != nil {
+		return stats, fmt.Errorf("failed to get memory usage: %v", err)
+	}
+	stats.RAMInMB = float64(memInfo.RSS) / (1024 * 1024)
+	return stats, nil
+}
+
+func (r *processRuntime) pid() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cmd == nil || r.cmd.Process == nil {
+		return 0, errors.New("process is not started")
+	}
+	return r.cmd.Process.Pid, nil
+}
+
+var (
+	runtimeDirOnce sync.Once
+	runtimeDirPath string
+	runtimeDirErr  error
+)
+
+// runtimeDir returns the private directory holding worker sockets. It is taken
+// from WORKERS_RUNTIME_DIR or created in the system temp dir, and is only
+// accessible to the hub user.
+func runtimeDir() (string, error) {
+	runtimeDirOnce.Do(func() {
+		dir := os.Getenv("WORKERS_RUNTIME_DIR")
+		if dir == "" {
+			runtimeDirPath, runtimeDirErr = os.MkdirTemp("", "model-hub-")
+			return
+		}
+		if runtimeDirErr = os.MkdirAll(dir, 0700); runtimeDirErr != nil {
+			return
+		}
+		runtimeDirErr = os.Chmod(dir, 0700)
+		runtimeDirPath = dir
+	})
+	return runtimeDirPath, runtimeDirErr
+}
@@ -0,0 +1,91 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"model-hub/config"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// remoteRuntime forwards predictions to a worker running on another host.
+// The remote side must serve POST /predict and GET /ping.
+type remoteRuntime struct {
+	id     WorkerId
+	url    string
+	client *http.Client
+	cancel context.CancelFunc
+	events RuntimeEvents
+	logger *zap.Logger
+}
+
+func newRemoteRuntime(id WorkerId, model config.Model, url string, events RuntimeEvents, logger *zap.Logger) *remoteRuntime {
+	return &remoteRuntime{
+		id:     id,
+		url:    strings.TrimSuffix(url, "/"),
+		client: newHTTPClient(model, nil),
+		events: events,
+		logger: logger,
+	}
+}
+
+// Start waits in the background until the remote endpoint answers and reports it ready.
+func (r *remoteRuntime) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	go func() {
+		for {
+			err := r.Health()
+			if err == nil {
+				r.events.Ready()
+				return
+			}
+			r.logger.Warn(fmt.Sprintf("Worker %s: remote endpoint is not reachable: %v", r.id, err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *remoteRuntime) Stop() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return nil
+}
+
+func (r *remoteRuntime) Predict(ctx context.Context, body []byte) (*Prediction, error) {
+	return postPredict(ctx, r.client, r.id, r.url+"/predict", body)
+}
+
+func (r *remoteRuntime) Close() {
+	r.client.CloseIdleConnections()
+}
+
+func (r *remoteRuntime) Health() error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(r.url + "/ping")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *remoteRuntime) Stats() (RuntimeStats, error) {
+	return RuntimeStats{}, nil
+}
+
+func (r *remoteRuntime) Address() string {
+	return r.url
+}
@@ -0,0 +1,152 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"model-hub/config"
+	"model-hub/models"
+	"model-hub/test/fixtures"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// postPredictDecoded is the predict path before requests were forwarded raw: the
+// request is decoded and marshalled again, and the response is decoded for the caller.
+func postPredictDecoded(client *http.Client, url string, body []byte) (interface{}, error) {
+	var request models.PredictRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response interface{}
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func BenchmarkPostPredict(b *testing.B) {
+	for _, size := range []int{1 << 20, 8 << 20} {
+		body := fixtures.PredictPayload("m", size)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a worker returning a response as large as the request
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+		client := server.Client()
+
+		b.Run(fmt.Sprintf("decoded/%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(2 * len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := postPredictDecoded(client, server.URL, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("passthrough/%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(2 * len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				prediction, err := postPredict(context.Background(), client, "m-1", server.URL, body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				// the handler streams the response to the client
+				if _, err := io.Copy(io.Discard, prediction.Body); err != nil {
+					b.Fatal(err)
+				}
+				prediction.Body.Close()
+			}
+		})
+		server.Close()
+	}
+}
+
+func TestPostPredictErrors(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the worker dies while it serves the request
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer broken.Close()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	model := config.Model{DialTimeout: time.Second, ResponseHeaderTimeout: 50 * time.Millisecond}
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		url       string
+		transport bool // whether the error is a worker fault
+		dial      bool // whether the request never reached the worker
+	}{
+		{name: "response header timeout", ctx: context.Background(), url: slow.URL},
+		{name: "cancelled", ctx: cancelled, url: slow.URL},
+		{name: "connection refused", ctx: context.Background(), url: closed.URL, transport: true, dial: true},
+		{name: "connection broken", ctx: context.Background(), url: broken.URL, transport: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := postPredict(test.ctx, newHTTPClient(model, nil), "m-1", test.url, []byte(`{"instances":[1]}`))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			var transportErr *TransportError
+			if errors.As(err, &transportErr) != test.transport {
+				t.Fatalf("%v: transport error %t, want %t", err, !test.transport, test.transport)
+			}
+			if test.transport && transportErr.Dial != test.dial {
+				t.Errorf("%v: dial error %t, want %t", err, transportErr.Dial, test.dial)
+			}
+		})
+	}
+}
+
+func TestProcessRuntimeStopAfterExit(t *testing.T) {
+	model := config.Model{Name: "m", Runtime: config.RuntimeCommand, Command: []string{"true"}, Transport: config.TransportTCP}
+	events := RuntimeEvents{Ready: func() {}, Exited: func(error) {}, Reassigned: func(string) {}}
+	ports, err := newPortAllocator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newProcessRuntime("m-1", model, ports, events)
+	defer r.Close()
+	for i := 0; i < 20; i++ {
+		if err := r.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// stop while the process exits on its own
+		time.Sleep(time.Duration(i%10) * time.Millisecond)
+		if err := r.Stop(); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package workers
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"model-hub/config"
+	"time"
+)
+
+// Scheduler decides in which order the queued requests of a model get workers.
+type Scheduler interface {
+	Push(request *WorkerRequest)
+	// Pop returns the next request with at least minPriority, or nil if there is none.
+	Pop(minPriority int) *WorkerRequest
+	// Remove takes a request out of the queue. It returns false if the request is not queued.
+	Remove(request *WorkerRequest) bool
+	Len() int
+}
+
+// newScheduler creates the scheduler configured for the model.
+func newScheduler(model config.Model) (Scheduler, error) {
+	epoch := time.Now()
+	switch model.Scheduler {
+	case "", config.SchedulerPriority:
+		return newQueueScheduler(priorityRank(model.Aging, epoch)), nil
+	case config.SchedulerFIFO:
+		return newQueueScheduler(fifoRank), nil
+	case config.SchedulerEDF:
+		return newQueueScheduler(deadlineRank(epoch)), nil
+	case config.SchedulerFair:
+		return newFairScheduler(model, priorityRank(model.Aging, epoch)), nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler %q", model.Scheduler)
+	}
+}
+
+// rankFunc gives the rank of a request when it is queued. Higher ranks are
+// served first, equal ranks in arrival order.
+type rankFunc func(request *WorkerRequest) float64
+
+// priorityRank orders by priority. With aging, a request's effective priority
+// grows linearly with its wait time. As all requests age at the same rate,
+// their order only depends on priority - rate*enqueuedAt.
+func priorityRank(aging *config.Aging, epoch time.Time) rankFunc {
+	var rate float64
+	if aging != nil {
+		rate = aging.Step / aging.Interval.Seconds()
+	}
+	return func(request *WorkerRequest) float64 {
+		return float64(request.priority) - rate*request.enqueuedAt.Sub(epoch).Seconds()
+	}
+}
+
+func fifoRank(*WorkerRequest) float64 {
+	return 0
+}
+
+// deadlineRank serves the earliest deadline first. Requests without a deadline
+// come after all requests with one.
+func deadlineRank(epoch time.Time) rankFunc {
+	return func(request *WorkerRequest) float64 {
+		if request.deadline.IsZero() {
+			return math.Inf(-1)
+		}
+		return -request.deadline.Sub(epoch).Seconds()
+	}
+}
+
+// queueScheduler keeps the requests in a single heap ordered by rank.
+type queueScheduler struct {
+	queue *WorkerQueue
+	rank  rankFunc
+}
+
+func newQueueScheduler(rank rankFunc) *queueScheduler {
+	queue := new(WorkerQueue)
+	heap.Init(queue)
+	return &queueScheduler{queue: queue, rank: rank}
+}
+
+func (s *queueScheduler) Push(request *WorkerRequest) {
+	request.rank = s.rank(request)
+	heap.Push(s.queue, request)
+}
+
+func (s *queueScheduler) Pop(minPriority int) *WorkerRequest {
+	i := s.find(minPriority)
+	if i < 0 {
+		return nil
+	}
+	return heap.Remove(s.queue, i).(*WorkerRequest)
+}
+
+// find returns the index of the first request in order with at least
+// minPriority, or -1. The head is checked first, the rest of the heap is only
+// scanned when the head does not qualify.
+func (s *queueScheduler) find(minPriority int) int {
+	queue := *s.queue
+	if len(queue) == 0 {
+		return -1
+	}
+	if queue[0].priority >= minPriority {
+		return 0
+	}
+	best := -1
+	for i := 1; i < len(queue); i++ {
+		if queue[i].priority >= minPriority && (best < 0 || queue.Less(i, best)) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (s *queueScheduler) Remove(request *WorkerRequest) bool {
+	if request.index < 0 || request.index >= s.queue.Len() || (*s.queue)[request.index] != request {
+		return false
+	}
+	heap.Remove(s.queue, request.index)
+	return true
+}
+
+func (s *queueScheduler) Len() int {
+	return s.queue.Len()
+}
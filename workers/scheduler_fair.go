@@ -0,0 +1,95 @@
+package workers
+
+import (
+	"model-hub/config"
+)
+
+// fairScheduler shares the workers of a model between tenants in proportion to
+// their weights (stride scheduling). Each tenant has its own queue ordered by
+// priority; the tenant with the lowest pass is served next and its pass then
+// advances by 1/weight. Ties between tenants are broken by name so the order
+// is deterministic.
+type fairScheduler struct {
+	tenants map[string]*tenantQueue
+	model   config.Model
+	rank    rankFunc
+	pass    float64 // pass of the last served tenant
+	length  int
+}
+
+type tenantQueue struct {
+	name   string
+	weight float64
+	pass   float64
+	queue  *queueScheduler
+}
+
+func newFairScheduler(model config.Model, rank rankFunc) *fairScheduler {
+	return &fairScheduler{
+		tenants: make(map[string]*tenantQueue),
+		model:   model,
+		rank:    rank,
+	}
+}
+
+func (s *fairScheduler) tenant(name string) *tenantQueue {
+	tenant, ok := s.tenants[name]
+	if !ok {
+		weight := s.model.TenantConfig(name).Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		tenant = &tenantQueue{name: name, weight: weight, queue: newQueueScheduler(s.rank)}
+		s.tenants[name] = tenant
+	}
+	return tenant
+}
+
+func (s *fairScheduler) Push(request *WorkerRequest) {
+	tenant := s.tenant(request.tenant)
+	if tenant.queue.Len() == 0 && tenant.pass < s.pass {
+		// an idle tenant does not accumulate credit
+		tenant.pass = s.pass
+	}
+	tenant.queue.Push(request)
+	s.length++
+}
+
+func (s *fairScheduler) Pop(minPriority int) *WorkerRequest {
+	var next *tenantQueue
+	for name, tenant := range s.tenants {
+		if tenant.queue.Len() == 0 {
+			if tenant.pass <= s.pass {
+				// nothing to remember, it would restart from the current pass anyway
+				delete(s.tenants, name)
+			}
+			continue
+		}
+		if tenant.queue.find(minPriority) < 0 {
+			continue
+		}
+		if next == nil || tenant.pass < next.pass || (tenant.pass == next.pass && tenant.name < next.name) {
+			next = tenant
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	s.pass = next.pass
+	next.pass += 1 / next.weight
+	s.length--
+	return next.queue.Pop(minPriority)
+}
+
+func (s *fairScheduler) Remove(request *WorkerRequest) bool {
+	tenant, ok := s.tenants[request.tenant]
+	if !ok || !tenant.queue.Remove(request) {
+		return false
+	}
+	s.length--
+	return true
+}
+
+func (s *fairScheduler) Len() int {
+	return s.length
+}
@@ -0,0 +1,262 @@
+package workers
+
+import (
+	"math"
+	"model-hub/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRequest is a request queued at enqueued before the test starts, with a
+// deadline relative to the test start (none if zero).
+type testRequest struct {
+	name     string
+	priority int
+	tenant   string
+	enqueued time.Duration
+	deadline time.Duration
+}
+
+// pushAll queues the requests in order and returns their names by request.
+func pushAll(scheduler Scheduler, requests []testRequest) map[*WorkerRequest]string {
+	now := time.Now()
+	names := make(map[*WorkerRequest]string)
+	for i, r := range requests {
+		request := NewWorkerRequest(RequestOptions{Priority: r.priority, Tenant: r.tenant})
+		if r.deadline != 0 {
+			request.deadline = now.Add(r.deadline)
+		}
+		request.enqueuedAt = now.Add(-r.enqueued)
+		request.seq = uint64(i + 1)
+		scheduler.Push(request)
+		names[request] = r.name
+	}
+	return names
+}
+
+// popAll pops requests with minPriority until none is left and returns their names in order.
+func popAll(scheduler Scheduler, names map[*WorkerRequest]string, minPriority int) string {
+	var order []string
+	for request := scheduler.Pop(minPriority); request != nil; request = scheduler.Pop(minPriority) {
+		order = append(order, names[request])
+	}
+	return strings.Join(order, " ")
+}
+
+func newTestScheduler(t *testing.T, model config.Model) Scheduler {
+	t.Helper()
+	scheduler, err := newScheduler(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scheduler
+}
+
+func TestQueueSchedulers(t *testing.T) {
+	aging := &config.Aging{Interval: time.Second, Step: 1}
+	tests := []struct {
+		name        string
+		model       config.Model
+		requests    []testRequest
+		minPriority int
+		want        string
+		left        int
+	}{
+		{
+			name:  "priority, equal priorities in arrival order",
+			model: config.Model{Scheduler: config.SchedulerPriority},
+			requests: []testRequest{
+				{name: "a", priority: 1}, {name: "b", priority: 5}, {name: "c", priority: 5}, {name: "d", priority: 3},
+			},
+			minPriority: math.MinInt,
+			want:        "b c d a",
+		},
+		{
+			name:  "priority with aging",
+			model: config.Model{Scheduler: config.SchedulerPriority, Aging: aging},
+			requests: []testRequest{
+				// waited 10s, effective priority 11
+				{name: "old", priority: 1, enqueued: 10 * time.Second},
+				{name: "high", priority: 5},
+				{name: "higher", priority: 12},
+			},
+			minPriority: math.MinInt,
+			want:        "higher old high",
+		},
+		{
+			name:  "priority with minimum priority scans past the head",
+			model: config.Model{Scheduler: config.SchedulerPriority},
+			requests: []testRequest{
+				{name: "a", priority: 9}, {name: "b", priority: 2}, {name: "c", priority: 6}, {name: "d", priority: 4},
+			},
+			minPriority: 5,
+			want:        "a c",
+			left:        2,
+		},
+		{
+			name:  "fifo ignores priorities",
+			model: config.Model{Scheduler: config.SchedulerFIFO},
+			requests: []testRequest{
+				{name: "a", priority: 1}, {name: "b", priority: 9}, {name: "c", priority: 5},
+			},
+			minPriority: math.MinInt,
+			want:        "a b c",
+		},
+		{
+			name:  "fifo with minimum priority",
+			model: config.Model{Scheduler: config.SchedulerFIFO},
+			requests: []testRequest{
+				{name: "a", priority: 1}, {name: "b", priority: 9}, {name: "c", priority: 5},
+			},
+			minPriority: 5,
+			want:        "b c",
+			left:        1,
+		},
+		{
+			name:  "edf, requests without a deadline last in arrival order",
+			model: config.Model{Scheduler: config.SchedulerEDF},
+			requests: []testRequest{
+				{name: "none1", priority: 9},
+				{name: "late", deadline: 10 * time.Second},
+				{name: "soon", deadline: 5 * time.Second},
+				{name: "none2"},
+				{name: "past", deadline: -time.Second},
+			},
+			minPriority: math.MinInt,
+			want:        "past soon late none1 none2",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduler := newTestScheduler(t, test.model)
+			names := pushAll(scheduler, test.requests)
+			if got := popAll(scheduler, names, test.minPriority); got != test.want {
+				t.Errorf("order %q, want %q", got, test.want)
+			}
+			if scheduler.Len() != test.left {
+				t.Errorf("%d requests left, want %d", scheduler.Len(), test.left)
+			}
+		})
+	}
+}
+
+func TestFairScheduler(t *testing.T) {
+	model := config.Model{
+		Scheduler: config.SchedulerFair,
+		Tenants: map[string]config.Tenant{
+			"a": {Weight: 3},
+			"b": {Weight: 1},
+		},
+	}
+	repeat := func(tenant string, count int) []testRequest {
+		requests := make([]testRequest, count)
+		for i := range requests {
+			requests[i] = testRequest{name: tenant, tenant: tenant}
+		}
+		return requests
+	}
+	tests := []struct {
+		name        string
+		model       config.Model
+		requests    []testRequest
+		minPriority int
+		want        string
+	}{
+		{
+			name:        "stride by weight",
+			model:       model,
+			requests:    append(repeat("a", 6), repeat("b", 3)...),
+			minPriority: math.MinInt,
+			want:        "a b a a a b a a b",
+		},
+		{
+			name:        "equal weights alternate, ties by tenant name",
+			model:       config.Model{Scheduler: config.SchedulerFair},
+			requests:    append(repeat("b", 3), repeat("a", 3)...),
+			minPriority: math.MinInt,
+			want:        "a b a b a b",
+		},
+		{
+			name:  "priority within a tenant",
+			model: model,
+			requests: []testRequest{
+				{name: "a1", tenant: "a", priority: 1}, {name: "a5", tenant: "a", priority: 5},
+			},
+			minPriority: math.MinInt,
+			want:        "a5 a1",
+		},
+		{
+			name:  "minimum priority skips tenants without a qualifying request",
+			model: model,
+			requests: []testRequest{
+				{name: "a1", tenant: "a", priority: 1}, {name: "b9", tenant: "b", priority: 9}, {name: "a7", tenant: "a", priority: 7},
+			},
+			minPriority: 5,
+			want:        "a7 b9",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduler := newTestScheduler(t, test.model)
+			names := pushAll(scheduler, test.requests)
+			if got := popAll(scheduler, names, test.minPriority); got != test.want {
+				t.Errorf("order %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFairSchedulerIdleTenantGetsNoCredit(t *testing.T) {
+	scheduler := newTestScheduler(t, config.Model{Scheduler: config.SchedulerFair})
+	names := pushAll(scheduler, []testRequest{{name: "a", tenant: "a"}, {name: "a", tenant: "a"}, {name: "a", tenant: "a"}, {name: "a", tenant: "a"}})
+	popAll(scheduler, names, math.MinInt)
+
+	// b was idle while a was served, it must not get four turns in a row now
+	for request, name := range pushAll(scheduler, append([]testRequest{{name: "b", tenant: "b"}, {name: "b", tenant: "b"}},
+		testRequest{name: "a", tenant: "a"}, testRequest{name: "a", tenant: "a"})) {
+		names[request] = name
+	}
+	if got, want := popAll(scheduler, names, math.MinInt), "b a b a"; got != want {
+		t.Errorf("order %q, want %q", got, want)
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	for _, model := range []config.Model{
+		{Scheduler: config.SchedulerPriority},
+		{Scheduler: config.SchedulerFIFO},
+		{Scheduler: config.SchedulerEDF},
+		{Scheduler: config.SchedulerFair},
+	} {
+		t.Run(model.Scheduler, func(t *testing.T) {
+			scheduler := newTestScheduler(t, model)
+			names := pushAll(scheduler, []testRequest{
+				{name: "a", priority: 3, tenant: "x", deadline: time.Second},
+				{name: "b", priority: 2, tenant: "y", deadline: 2 * time.Second},
+				{name: "c", priority: 1, tenant: "x", deadline: 3 * time.Second},
+			})
+			var b *WorkerRequest
+			for request, name := range names {
+				if name == "b" {
+					b = request
+				}
+			}
+			if !scheduler.Remove(b) {
+				t.Fatal("queued request not removed")
+			}
+			if scheduler.Remove(b) {
+				t.Error("request removed twice")
+			}
+			if scheduler.Remove(NewWorkerRequest(RequestOptions{Tenant: "unknown"})) {
+				t.Error("request that was never queued removed")
+			}
+			if scheduler.Len() != 2 {
+				t.Errorf("%d requests left, want 2", scheduler.Len())
+			}
+			if got := popAll(scheduler, names, math.MinInt); got != "a c" {
+				t.Errorf("order %q, want %q", got, "a c")
+			}
+		})
+	}
+}
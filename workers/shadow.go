@@ -0,0 +1,191 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"model-hub/config"
+	"model-hub/models"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowTenant is the tenant of shadow requests.
+	shadowTenant = "shadow"
+	// maxRecordedBody is the largest response kept for a shadow record.
+	maxRecordedBody = 1 << 20
+)
+
+// shadowRecord is a line of a shadow JSONL file.
+type shadowRecord struct {
+	Time            time.Time        `json:"time"`
+	Model           models.ModelName `json:"model"`
+	ShadowModel     models.ModelName `json:"shadow_model"`
+	Request         json.RawMessage  `json:"request"`
+	Primary         interface{}      `json:"primary,omitempty"`
+	PrimaryError    string           `json:"primary_error,omitempty"`
+	PrimaryLatency  float64          `json:"primary_latency_ms"`
+	Shadow          interface{}      `json:"shadow,omitempty"`
+	ShadowError     string           `json:"shadow_error,omitempty"`
+	ShadowLatency   float64          `json:"shadow_latency_ms"`
+	ResponsesEqual  bool             `json:"responses_equal"`
+	ResponseTrimmed bool             `json:"response_trimmed,omitempty"`
+}
+
+// shadowOutcome is the primary response a shadow response is compared with.
+type shadowOutcome struct {
+	body    []byte
+	trimmed bool
+	err     error
+	latency time.Duration
+}
+
+// shadowRecorder appends shadow records to a JSONL file.
+type shadowRecorder struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+func newShadowRecorder(path string) (*shadowRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shadow record file: %v", err)
+	}
+	return &shadowRecorder{file: file}, nil
+}
+
+func (r *shadowRecorder) write(record shadowRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// startShadow sends a copy of a sampled request to the shadow model of the
+// model. If the shadow is recorded, the returned channel takes the outcome of
+// the primary request.
+func (wm *WorkerManager) startShadow(model config.Model, body []byte) chan<- shadowOutcome {
+	if model.Shadow == nil || rand.Float64() >= model.Shadow.Sample {
+		return nil
+	}
+	var primary chan shadowOutcome
+	if _, ok := wm.recorders[model.Name]; ok {
+		primary = make(chan shadowOutcome, 1)
+	}
+	go wm.shadow(model, body, primary)
+	return primary
+}
+
+// shadow serves a shadow request with an idle worker of the shadow model, and
+// drops it if none is idle, so shadow requests never wait or delay others.
+func (wm *WorkerManager) shadow(model config.Model, body []byte, primary <-chan shadowOutcome) {
+	stats := wm.stats[model.Name]
+	shadowModel := wm.resolve(model.Shadow.Model)
+	d, ok := wm.dispatchers[shadowModel]
+	if !ok {
+		return
+	}
+	worker := d.tryAcquire(NewWorkerRequest(RequestOptions{Priority: math.MinInt, Tenant: shadowTenant}))
+	if worker == nil {
+		stats.observeShadow(false)
+		return
+	}
+	stats.observeShadow(true)
+
+	start := time.Now()
+	var response []byte
+	var trimmed bool
+	prediction, err := worker.Predict(context.Background(), body)
+	if err == nil {
+		response, trimmed, err = readLimited(prediction.Body)
+		prediction.Body.Close()
+	}
+	latency := time.Since(start)
+	wm.ReleaseWorker(worker.ID)
+	if primary == nil {
+		return
+	}
+
+	outcome := <-primary
+	record := shadowRecord{
+		Time:            start,
+		Model:           model.Name,
+		ShadowModel:     shadowModel,
+		Request:         body,
+		Primary:         recordedBody(outcome.body),
+		PrimaryLatency:  float64(outcome.latency.Microseconds()) / 1000,
+		Shadow:          recordedBody(response),
+		ShadowLatency:   float64(latency.Microseconds()) / 1000,
+		ResponseTrimmed: trimmed || outcome.trimmed,
+	}
+	if outcome.err != nil {
+		record.PrimaryError = outcome.err.Error()
+	}
+	if err != nil {
+		record.ShadowError = err.Error()
+	}
+	record.ResponsesEqual = outcome.err == nil && err == nil && bytes.Equal(bytes.TrimSpace(outcome.body), bytes.TrimSpace(response))
+	if err := wm.recorders[model.Name].write(record); err != nil {
+		wm.logger.Error(fmt.Sprintf("Model %s: failed to record shadow response: %v", model.Name, err))
+	}
+}
+
+func readLimited(body io.Reader) ([]byte, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxRecordedBody+1))
+	if len(data) > maxRecordedBody {
+		return data[:maxRecordedBody], true, err
+	}
+	return data, false, err
+}
+
+// recordedBody keeps JSON responses as they are and other responses as strings.
+func recordedBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
+
+// recordingBody keeps a copy of the primary response while it is streamed to
+// the client, and reports it when the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	copy    bytes.Buffer
+	trimmed bool
+	start   time.Time
+	primary chan<- shadowOutcome
+	once    sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	kept := n
+	if room := maxRecordedBody - b.copy.Len(); kept > room {
+		b.trimmed = true
+		kept = room
+	}
+	b.copy.Write(p[:kept])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.primary <- shadowOutcome{body: b.copy.Bytes(), trimmed: b.trimmed, latency: time.Since(b.start)}
+	})
+	return err
+}
@@ -0,0 +1,83 @@
+package workers
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"model-hub/config"
+	"model-hub/models"
+)
+
+// trafficSplit spreads the requests of a split model over its variants by weight.
+type trafficSplit struct {
+	name     models.ModelName
+	variants []config.SplitVariant
+	total    int
+	stats    map[models.ModelName]*modelStats // Prediction statistics by variant
+}
+
+func newTrafficSplit(model config.Model) *trafficSplit {
+	split := &trafficSplit{
+		name:     model.Name,
+		variants: model.Split,
+		stats:    make(map[models.ModelName]*modelStats),
+	}
+	for _, variant := range model.Split {
+		split.total += variant.Weight
+		split.stats[variant.Model] = &modelStats{}
+	}
+	return split
+}
+
+// choose picks a variant for a request. Requests with the same routing key are
+// always sent to the same variant, as long as the weights do not change.
+func (s *trafficSplit) choose(routingKey string) models.ModelName {
+	var point int
+	if routingKey != "" {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(string(s.name) + "/" + routingKey))
+		point = int(hash.Sum32() % uint32(s.total))
+	} else {
+		point = rand.Intn(s.total)
+	}
+	for _, variant := range s.variants {
+		if point < variant.Weight {
+			return variant.Model
+		}
+		point -= variant.Weight
+	}
+	return s.variants[len(s.variants)-1].Model
+}
+
+type VariantStatus struct {
+	Model      models.ModelName `json:"model"`
+	Weight     int              `json:"weight"`
+	Requests   int              `json:"requests"`
+	Errors     int              `json:"errors"`
+	LatencyP50 float64          `json:"latency_p50_ms"`
+	LatencyP95 float64          `json:"latency_p95_ms"`
+	LatencyP99 float64          `json:"latency_p99_ms"`
+}
+
+func (s *trafficSplit) status() ModelStatus {
+	status := ModelStatus{Model: s.name}
+	for _, variant := range s.variants {
+		variantStatus := newVariantStatus(variant.Model, variant.Weight, s.stats[variant.Model])
+		status.Requests += variantStatus.Requests
+		status.Errors += variantStatus.Errors
+		status.Variants = append(status.Variants, variantStatus)
+	}
+	return status
+}
+
+func newVariantStatus(model models.ModelName, weight int, stats *modelStats) VariantStatus {
+	status := stats.status()
+	return VariantStatus{
+		Model:      model,
+		Weight:     weight,
+		Requests:   status.Requests,
+		Errors:     status.Errors,
+		LatencyP50: status.LatencyP50,
+		LatencyP95: status.LatencyP95,
+		LatencyP99: status.LatencyP99,
+	}
+}
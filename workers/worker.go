@@ -1,7 +1,6 @@
 package workers
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,11 +8,6 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"model-hub/config"
-	"model-hub/models"
-	"net/http"
-	"os"
-	"os/exec"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -24,61 +18,113 @@ type Worker struct {
 	Launched         bool
 	Loaded           bool
 	Busy             bool
+	Endpoint         string // remote URL for workers backed by the remote runtime
+	Registered       bool   // joined through POST /workers/register
+	restarting       bool
+	warming          bool // receiving its warmup requests
+	standby          bool // started by a rollout, not handed out before the switch
+	retired          bool // replaced or removed, never started again
+	lastHeartbeat    time.Time
 	startTime        time.Time
-	cmd              *exec.Cmd
-	port             int
-	mu               sync.Mutex
+	runtime          Runtime
+	mu               sync.Mutex // guards the state fields only, never held during runtime calls
+	lifecycleMu      sync.Mutex // serializes Start and Stop
 	failedWorkerChan chan WorkerId
-	ctx              context.Context
-	cancel           context.CancelFunc
+	readyWorkerChan  chan WorkerId
 	logger           *zap.Logger
 }
 
-func NewWorker(id WorkerId, model config.Model, port int, failedWorkerChan chan WorkerId, logger *zap.Logger) *Worker {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Worker{
+// NewWorker creates the worker with the runtime selected by the model config.
+// endpoint is only used by the remote runtime, ports only by local processes.
+func NewWorker(id WorkerId, model config.Model, endpoint string, ports *portAllocator, failedWorkerChan chan WorkerId, readyWorkerChan chan WorkerId, logger *zap.Logger) *Worker {
+	w := &Worker{
 		ID:               id,
 		Model:            model,
 		Loaded:           false,
 		Busy:             false,
 		Launched:         false,
-		port:             port,
+		Endpoint:         endpoint,
 		failedWorkerChan: failedWorkerChan,
-		ctx:              ctx,
-		cancel:           cancel,
+		readyWorkerChan:  readyWorkerChan,
 		logger:           logger,
 	}
+	w.runtime = newRuntime(id, model, endpoint, ports, RuntimeEvents{
+		Ready:      w.onReady,
+		Exited:     w.onExited,
+		Reassigned: w.onReassigned,
+	}, logger)
+	return w
 }
 
 func (w *Worker) Start() {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.cancel != nil {
-		w.cancel()
+	if err := w.start(); err != nil {
+		panic(fmt.Sprintf("failed to start worker %s: %v", w.ID, err))
 	}
-	w.ctx, w.cancel = context.WithCancel(context.Background())
-	cmd := exec.Command("python3", "worker.py", string(w.ID), w.Model.Path, strconv.Itoa(w.port), w.Model.Handler)
+}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+func (w *Worker) start() error {
+	w.lifecycleMu.Lock()
+	defer w.lifecycleMu.Unlock()
 
-	if err := cmd.Start(); err != nil {
-		panic(fmt.Sprintf("failed to start worker %s: %v", w.ID, err))
+	if w.IsRetired() {
+		return nil
 	}
+
+	if err := w.runtime.Start(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.Launched = true
+	w.restarting = false
 	w.startTime = time.Now()
+	return nil
+}
 
-	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			timeString := w.ElapsedTimeString()
+func (w *Worker) Stop() {
+	w.lifecycleMu.Lock()
+	defer w.lifecycleMu.Unlock()
 
-			w.logger.Error(fmt.Sprintf("Worker %s: command exited with error: %v, worked for %s", w.ID, err, timeString))
-			w.failedWorkerChan <- w.ID
-		}
-	}()
+	if err := w.runtime.Stop(); err != nil {
+		w.logger.Error(fmt.Sprintf("Worker %s: failed to stop: %v", w.ID, err))
+	}
+	w.SetExited()
+}
 
-	w.cmd = cmd
+// Close releases the resources of a retired worker after it was stopped.
+func (w *Worker) Close() {
+	w.lifecycleMu.Lock()
+	defer w.lifecycleMu.Unlock()
+
+	w.runtime.Close()
+}
+
+func (w *Worker) onReady() {
+	w.readyWorkerChan <- w.ID
+}
+
+func (w *Worker) onExited(err error) {
+	timeString := w.ElapsedTimeString()
+
+	w.logger.Error(fmt.Sprintf("Worker %s: command exited with error: %v, worked for %s", w.ID, err, timeString))
+	w.failedWorkerChan <- w.ID
+}
+
+func (w *Worker) onReassigned(reason string) {
+	w.logger.Warn(fmt.Sprintf("Worker %s: %s", w.ID, reason))
+}
+
+func (w *Worker) Address() string {
+	return w.runtime.Address()
+}
+
+func (w *Worker) Health() error {
+	return w.runtime.Health()
+}
+
+func (w *Worker) Stats() (RuntimeStats, error) {
+	return w.runtime.Stats()
 }
 
 func (w *Worker) SetLoaded() {
@@ -137,46 +183,121 @@ func (w *Worker) SetAvailable() {
 	w.Busy = false
 }
 
-func (w *Worker) Predict(request models.PredictRequest) (response interface{}, err error) {
+func (w *Worker) IsBusy() bool {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Marshal the request object
-	reqBody, err := json.Marshal(request)
-	if err != nil {
-		return response, fmt.Errorf("worker %s: failed to marshal request: %v", w.ID, err)
-	}
+	return w.Busy
+}
 
-	// Create the POST request
-	url := fmt.Sprintf("http://127.0.0.1:%d/predict", w.port)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return response, fmt.Errorf("worker %s: failed to create POST request: %v", w.ID, err)
-	}
-	req.Header.Set("Content-Type", "application/json")
+// Retire marks the worker as no longer used: it is not handed out or restarted again.
+func (w *Worker) Retire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return response, fmt.Errorf("worker %s: failed to send POST request: %v", w.ID, err)
-	}
-	defer resp.Body.Close()
-	respBody, err := io.ReadAll(resp.Body)
+	w.retired = true
+	w.Loaded = false
+}
+
+func (w *Worker) IsRetired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	if resp.StatusCode != http.StatusOK {
-		return response, errors.New(string(respBody))
+	return w.retired
+}
+
+func (w *Worker) setStandby(standby bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.standby = standby
+}
+
+func (w *Worker) isStandby() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.standby
+}
+
+// beginRestart returns false if a restart of the worker is already in progress
+// or the worker is retired.
+func (w *Worker) beginRestart() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.restarting || w.retired {
+		return false
 	}
+	w.restarting = true
+	return true
+}
 
-	// Read and unmarshal the response
-	if err != nil {
-		return response, fmt.Errorf("worker %s: failed to read response body: %v", w.ID, err)
+// beginWarmup returns false if the worker is already warming up.
+func (w *Worker) beginWarmup() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.warming {
+		return false
 	}
+	w.warming = true
+	return true
+}
 
-	err = json.Unmarshal(respBody, &response)
-	if err != nil {
-		return response, fmt.Errorf("worker %s: failed to unmarshal response: %v", w.ID, err)
+func (w *Worker) endWarmup() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.warming = false
+}
+
+func (w *Worker) Heartbeat() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.lastHeartbeat = time.Now()
+}
+
+func (w *Worker) HeartbeatExpired(timeout time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.Registered && time.Since(w.lastHeartbeat) > timeout
+}
+
+// Predict forwards the raw request body to the worker. The response body is
+// streamed from the worker, so the worker stays busy until it is closed.
+// Connection failures are reported to the failure handler, cancelling ctx is not
+// a failure.
+//
+// No lock is held during the call: the dispatcher hands a worker to a single
+// request at a time, and state reads or crash handling must not wait for it.
+func (w *Worker) Predict(ctx context.Context, body []byte) (*Prediction, error) {
+	prediction, err := w.runtime.Predict(ctx, body)
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		w.logger.Error(fmt.Sprintf("Worker %s: connection failed: %v", w.ID, transportErr.Err))
+		// not handed out again when released, until it is restarted
+		w.SetUnLoaded()
+		go func() {
+			w.failedWorkerChan <- w.ID
+		}()
 	}
+	return prediction, err
+}
 
-	return response, nil
+// warmUp sends the requests to the worker one after the other and discards the responses.
+func (w *Worker) warmUp(ctx context.Context, requests []json.RawMessage) error {
+	for _, body := range requests {
+		prediction, err := w.Predict(ctx, body)
+		if err == nil {
+			_, err = io.Copy(io.Discard, prediction.Body)
+			prediction.Body.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,17 +1,38 @@
 package workers
 
-import "container/heap"
+import (
+	"container/heap"
+	"time"
+)
+
+// RequestOptions are the request properties used for scheduling and routing.
+type RequestOptions struct {
+	Priority int
+	Tenant   string
+	Deadline time.Time // zero if the request has no deadline
+	// MaxWait is how long the request may wait for a worker, zero for no limit.
+	MaxWait time.Duration
+	// RoutingKey keeps requests on the same variant of a traffic split.
+	RoutingKey string
+}
 
 type WorkerRequest struct {
 	worker     *Worker
 	resultChan chan *Worker
 	priority   int
+	tenant     string
+	deadline   time.Time
 	index      int
+	enqueuedAt time.Time
+	seq        uint64  // arrival order, breaks ties between equal ranks
+	rank       float64 // order given by the scheduler, fixed when the request is queued
 }
 
-func NewWorkerRequest(priority int) *WorkerRequest {
+func NewWorkerRequest(options RequestOptions) *WorkerRequest {
 	return &WorkerRequest{
-		priority:   priority,
+		priority:   options.Priority,
+		tenant:     options.Tenant,
+		deadline:   options.Deadline,
 		resultChan: make(chan *Worker, 1), // Buffered channel so sending goroutine does not block
 	}
 }
@@ -22,7 +43,10 @@ type WorkerQueue []*WorkerRequest
 func (wq WorkerQueue) Len() int { return len(wq) }
 func (wq WorkerQueue) Less(i, j int) bool {
 	// We want Pop to give the highest priority element, so we use > instead of <.
-	return wq[i].priority > wq[j].priority
+	if wq[i].rank != wq[j].rank {
+		return wq[i].rank > wq[j].rank
+	}
+	return wq[i].seq < wq[j].seq
 }
 func (wq WorkerQueue) Swap(i, j int) {
 	wq[i], wq[j] = wq[j], wq[i]
@@ -1,103 +1,178 @@
 package workers
 
 import (
-	"container/heap"
+	"context"
 	"fmt"
 	"go.uber.org/zap"
 	"model-hub/config"
 	"model-hub/helper"
 	"model-hub/models"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type WorkerId string
 
+// restartDelay is how long a failed worker stays down before it is started again,
+// and between start attempts that fail.
+var restartDelay = 5 * time.Second
+
 type WorkerManager struct {
-	workers             map[WorkerId]*Worker                     // Existing workers
-	failedWorkerChan    chan WorkerId                            // Channel for failed workers
-	workerAvailableChan map[models.ModelName]chan WorkerId       // Channel for notification about worker ready
-	modelNames          []models.ModelName                       // Models list
-	workerRequestChan   map[models.ModelName]chan *WorkerRequest // WorkerRequest channel by models
-	workerQueues        map[models.ModelName]*WorkerQueue        // WorkerQueue heap by model
-	mu                  sync.Mutex
-	logger              *zap.Logger
+	workers          map[WorkerId]*Worker                  // Existing workers
+	failedWorkerChan chan WorkerId                         // Channel for failed workers
+	readyWorkerChan  chan WorkerId                         // Channel for workers whose runtime reported readiness
+	modelNames       []models.ModelName                    // Models list
+	dispatchers      map[models.ModelName]*dispatcher      // Request queue and idle workers by model
+	models           map[models.ModelName]config.Model     // Model configs by name
+	stats            map[models.ModelName]*modelStats      // Prediction statistics by model
+	breakers         map[models.ModelName]*circuitBreaker  // Circuit breakers of the models that have one
+	aliases          map[models.ModelName]models.ModelName // Model names and aliases pointing to versions
+	splits           map[models.ModelName]*trafficSplit    // Traffic splits between other models
+	pipelines        map[models.ModelName]*pipeline        // Chains of other models
+	recorders        map[models.ModelName]*shadowRecorder  // Shadow record files of the models that record them
+	canaries         map[models.ModelName]*canary          // Last canary by alias
+	registeredSeq    int                                   // Sequence for registered remote worker IDs
+	ports            *portAllocator                        // Ports for local workers
+	workerSeq        map[models.ModelName]int              // Last local worker number by model
+	rollouts         map[models.ModelName]*RolloutStatus   // Last rollout by model
+	workersMu        sync.RWMutex
+	modelsMu         sync.RWMutex // guards models and rollouts, which change with rollouts
+	aliasesMu        sync.RWMutex // guards aliases and canaries
+	logger           *zap.Logger
 }
 
 func NewWorkerManager(cfg *config.Config, logger *zap.Logger) *WorkerManager {
 	workers := make(map[WorkerId]*Worker)
-	workerChan := make(map[models.ModelName]chan *Worker)
-	workerQueues := make(map[models.ModelName]*WorkerQueue)
-	workerRequestChan := make(map[models.ModelName]chan *WorkerRequest)
+	dispatchers := make(map[models.ModelName]*dispatcher)
 	var modelNames []models.ModelName
-	port := 7777
-	workerAvailableChan := make(map[models.ModelName]chan WorkerId)
+	ports, err := newPortAllocator(helper.GetEnv("WORKERS_PORT_RANGE", ""))
+	if err != nil {
+		panic("WORKERS_PORT_RANGE has invalid value: " + err.Error())
+	}
 	failedWorkerChan := make(chan WorkerId)
+	readyWorkerChan := make(chan WorkerId)
+	modelConfigs := make(map[models.ModelName]config.Model)
+	workerSeq := make(map[models.ModelName]int)
+	stats := make(map[models.ModelName]*modelStats)
+	breakers := make(map[models.ModelName]*circuitBreaker)
+	splits := make(map[models.ModelName]*trafficSplit)
+	pipelines := make(map[models.ModelName]*pipeline)
+	recorders := make(map[models.ModelName]*shadowRecorder)
 	for _, model := range cfg.Models {
+		modelConfigs[model.Name] = model
+		if len(model.Split) > 0 {
+			splits[model.Name] = newTrafficSplit(model)
+			continue
+		}
+		if len(model.Pipeline) > 0 {
+			pipelines[model.Name] = newPipeline(model)
+			continue
+		}
 		modelNames = append(modelNames, model.Name)
-		workerChan[model.Name] = make(chan *Worker, model.Workers)
+		workerSeq[model.Name] = model.Workers
+		stats[model.Name] = &modelStats{}
+		if model.CircuitBreaker != nil {
+			breakers[model.Name] = newCircuitBreaker(model, logger)
+		}
+		if model.Shadow != nil && model.Shadow.Record != "" {
+			recorders[model.Name], err = newShadowRecorder(model.Shadow.Record)
+			if err != nil {
+				panic(fmt.Sprintf("model %s: %v", model.Name, err))
+			}
+		}
 		for i := 1; i <= model.Workers; i++ {
-			port += 1
+			var endpoint string
+			if model.Runtime == config.RuntimeRemote {
+				endpoint = model.Endpoints[i-1]
+			}
 			workerID := WorkerId(fmt.Sprintf("%s-%d", model.Name, i))
-			worker := NewWorker(workerID, model, port, failedWorkerChan, logger)
+			worker := NewWorker(workerID, model, endpoint, ports, failedWorkerChan, readyWorkerChan, logger)
 			workers[workerID] = worker
 		}
-		workerRequestChan[model.Name] = make(chan *WorkerRequest)
-		workerQueues[model.Name] = new(WorkerQueue)
-		workerAvailableChan[model.Name] = make(chan WorkerId, model.Workers)
-		heap.Init(workerQueues[model.Name])
+		dispatchers[model.Name], err = newDispatcher(model, logger)
+		if err != nil {
+			panic(fmt.Sprintf("model %s: %v", model.Name, err))
+		}
 	}
 	return &WorkerManager{
-		workers:             workers,
-		workerAvailableChan: workerAvailableChan,
-		failedWorkerChan:    failedWorkerChan,
-		modelNames:          modelNames,
-		logger:              logger,
-		workerRequestChan:   workerRequestChan,
-		workerQueues:        workerQueues,
+		workers:          workers,
+		failedWorkerChan: failedWorkerChan,
+		readyWorkerChan:  readyWorkerChan,
+		modelNames:       modelNames,
+		logger:           logger,
+		dispatchers:      dispatchers,
+		models:           modelConfigs,
+		stats:            stats,
+		breakers:         breakers,
+		aliases:          cfg.Aliases,
+		splits:           splits,
+		pipelines:        pipelines,
+		recorders:        recorders,
+		canaries:         make(map[models.ModelName]*canary),
+		workerSeq:        workerSeq,
+		rollouts:         make(map[models.ModelName]*RolloutStatus),
+		ports:            ports,
 	}
 }
 
-func (wm *WorkerManager) removeWorkerFromChannel(worker *Worker) {
-	wm.mu.Lock()
-	defer wm.mu.Unlock()
+func (wm *WorkerManager) getWorker(workerID WorkerId) (*Worker, bool) {
+	wm.workersMu.RLock()
+	defer wm.workersMu.RUnlock()
 
-	// processing the worker request queue, removing worker from all requests
-	workerQueue := wm.workerQueues[worker.Model.Name]
-	newQueue := new(WorkerQueue)
-	heap.Init(newQueue)
+	worker, ok := wm.workers[workerID]
+	return worker, ok
+}
 
-	for _, request := range *workerQueue {
-		if request.worker == nil || request.worker.ID != worker.ID {
-			heap.Push(newQueue, request)
-		}
-	}
+// workerList returns a snapshot of the current workers.
+func (wm *WorkerManager) workerList() []*Worker {
+	wm.workersMu.RLock()
+	defer wm.workersMu.RUnlock()
 
-	wm.workerQueues[worker.Model.Name] = newQueue
+	list := make([]*Worker, 0, len(wm.workers))
+	for _, worker := range wm.workers {
+		list = append(list, worker)
+	}
+	return list
 }
 
 func (wm *WorkerManager) handleFailedWorker() {
 	for {
 		failedWorkerID := <-wm.failedWorkerChan
-		worker, ok := wm.workers[failedWorkerID]
-		if ok {
+		worker, ok := wm.getWorker(failedWorkerID)
+		if ok && worker.beginRestart() {
 			go func() {
 				worker.SetUnLoaded()
-				worker.SetExited()
-				wm.removeWorkerFromChannel(worker)
-				wm.logger.Info(fmt.Sprintf("Worker %s: Waiting 5 seconds before restarting", worker.ID))
-				time.Sleep(5 * time.Second)
-				worker.Start()
+				wm.dispatchers[worker.Model.Name].remove(worker)
+				worker.Stop()
+				for {
+					wm.logger.Info(fmt.Sprintf("Worker %s: Waiting %s before restarting", worker.ID, restartDelay))
+					time.Sleep(restartDelay)
+					// the worker stays restarting until a start succeeds, e.g. once a port is free again
+					err := worker.start()
+					if err == nil {
+						return
+					}
+					wm.logger.Error(fmt.Sprintf("Worker %s: failed to restart: %v", worker.ID, err))
+				}
 			}()
 		}
 	}
 }
 
-func (wm *WorkerManager) Initialize() {
-	for _, modelName := range wm.modelNames {
-		go wm.processWorkerRequests(modelName)
+func (wm *WorkerManager) handleReadyWorker() {
+	for {
+		readyWorkerID := <-wm.readyWorkerChan
+		wm.WorkerReady(readyWorkerID)
 	}
+}
+
+func (wm *WorkerManager) Initialize() {
 	go wm.handleFailedWorker()
+	go wm.handleReadyWorker()
+	go wm.monitorRemoteWorkers()
 	go wm.logResourceUsage()
 	loadingStrategy := helper.GetEnv("WORKERS_LOADING_STRATEGY", "parallel")
 	if loadingStrategy == "sequential" {
@@ -106,46 +181,16 @@ func (wm *WorkerManager) Initialize() {
 		wm.startWorkersParallel()
 	}
 }
-func (wm *WorkerManager) processWorkerRequests(modelName models.ModelName) {
-	for {
-		select {
-		case request := <-wm.workerRequestChan[modelName]:
-			// Add Request to heap
-			wm.mu.Lock()
-			heap.Push(wm.workerQueues[modelName], request)
-			wm.mu.Unlock()
-
-		case workerId := <-wm.workerAvailableChan[modelName]:
-			wm.mu.Lock()
-			if wm.workerQueues[modelName].Len() == 0 {
-				wm.workerAvailableChan[modelName] <- workerId
-				wm.mu.Unlock()
-				request := <-wm.workerRequestChan[modelName]
-				go func() {
-					wm.workerRequestChan[modelName] <- request
-				}()
-				continue
-			}
-
-			// Fetch prioritized request from heap
-			nextRequest := heap.Pop(wm.workerQueues[modelName]).(*WorkerRequest)
-			wm.mu.Unlock()
-
-			worker, exists := wm.workers[workerId]
-			if exists {
-				nextRequest.worker = worker
-				worker.SetBusy()
-				nextRequest.resultChan <- worker
-			} else {
-				wm.logger.Error("Worker not found", zap.String("workerId", string(workerId)))
-			}
-		}
-	}
-}
 
+// startWorkersSequentially waits for each local worker to load before starting
+// the next one. Remote workers do not load on this machine and may stay
+// unreachable for long, so they are started without waiting.
 func (wm *WorkerManager) startWorkersSequentially() {
-	for _, worker := range wm.workers {
+	for _, worker := range wm.workerList() {
 		worker.Start()
+		if worker.Model.Runtime == config.RuntimeRemote {
+			continue
+		}
 		for !worker.IsLoaded() {
 			time.Sleep(1 * time.Second)
 		}
@@ -153,28 +198,230 @@ func (wm *WorkerManager) startWorkersSequentially() {
 }
 
 func (wm *WorkerManager) startWorkersParallel() {
-	for _, worker := range wm.workers {
+	for _, worker := range wm.workerList() {
 		worker.Start()
 	}
 }
 
-func (wm *WorkerManager) GetAvailableWorker(modelName models.ModelName, priority int) (*Worker, error) {
-	if _, ok := wm.workerRequestChan[modelName]; !ok {
+// ModelConfig returns the configuration of a model, version or alias.
+func (wm *WorkerManager) ModelConfig(modelName models.ModelName) (config.Model, bool) {
+	return wm.modelConfig(wm.resolve(modelName))
+}
+
+func (wm *WorkerManager) modelConfig(modelName models.ModelName) (config.Model, bool) {
+	wm.modelsMu.RLock()
+	defer wm.modelsMu.RUnlock()
+
+	model, ok := wm.models[modelName]
+	return model, ok
+}
+
+// resolve returns the model an alias points to, or the name itself.
+func (wm *WorkerManager) resolve(name models.ModelName) models.ModelName {
+	wm.aliasesMu.RLock()
+	defer wm.aliasesMu.RUnlock()
+
+	if target, ok := wm.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// SetAlias points an alias to another version of its model.
+func (wm *WorkerManager) SetAlias(alias models.ModelName, target models.ModelName) error {
+	if err := wm.checkAlias(alias, target); err != nil {
+		return err
+	}
+
+	wm.aliasesMu.Lock()
+	defer wm.aliasesMu.Unlock()
+
+	if c, ok := wm.canaries[alias]; ok && c.status.State == CanaryRunning {
+		return fmt.Errorf("a canary of alias %s is running", alias)
+	}
+	previous := wm.aliases[alias]
+	wm.aliases[alias] = target
+	wm.logger.Info(fmt.Sprintf("Alias %s: retargeted from %q to %s", alias, previous, target))
+	return nil
+}
+
+// checkAlias reports whether the alias may point to the target.
+func (wm *WorkerManager) checkAlias(alias models.ModelName, target models.ModelName) error {
+	if _, ok := wm.modelConfig(alias); ok {
+		return fmt.Errorf("%s is a model, not an alias", alias)
+	}
+	if _, ok := wm.modelConfig(target); !ok {
+		return fmt.Errorf("unknown model %s", target)
+	}
+	if config.BaseName(alias) != config.BaseName(target) {
+		return fmt.Errorf("alias %s can only point to versions of %s", alias, config.BaseName(alias))
+	}
+	if _, version, ok := strings.Cut(string(alias), config.VersionSeparator); ok {
+		if _, err := strconv.Atoi(version); err == nil || version == "" {
+			return fmt.Errorf("invalid alias %s", alias)
+		}
+	}
+	return nil
+}
+
+// Aliases returns the current aliases and the models they point to.
+func (wm *WorkerManager) Aliases() map[models.ModelName]models.ModelName {
+	wm.aliasesMu.RLock()
+	defer wm.aliasesMu.RUnlock()
+
+	aliases := make(map[models.ModelName]models.ModelName, len(wm.aliases))
+	for alias, target := range wm.aliases {
+		aliases[alias] = target
+	}
+	return aliases
+}
+
+// GetAvailableWorker waits until a worker of the model is assigned to the request.
+// The request leaves the queue if ctx is done first.
+func (wm *WorkerManager) GetAvailableWorker(ctx context.Context, modelName models.ModelName, options RequestOptions) (*Worker, error) {
+	d, ok := wm.dispatchers[modelName]
+	if !ok {
 		return nil, fmt.Errorf("no worker channel for the requested model: %s", modelName)
 	}
-	request := NewWorkerRequest(priority)
-	wm.workerRequestChan[modelName] <- request
-	worker := <-request.resultChan
+	if options.Tenant == "" {
+		options.Tenant = config.DefaultTenant
+	}
+	request := NewWorkerRequest(options)
+	if err := d.acquire(request); err != nil {
+		return nil, err
+	}
 
-	return worker, nil
+	select {
+	case worker := <-request.resultChan:
+		return worker, nil
+	case <-ctx.Done():
+		if d.cancel(request) {
+			return nil, ctx.Err()
+		}
+		// a worker was assigned meanwhile, give it back
+		wm.ReleaseWorker((<-request.resultChan).ID)
+		return nil, ctx.Err()
+	}
 }
 
-func (wm *WorkerManager) SetWorkerAvailable(workerID WorkerId) {
-	worker, ok := wm.workers[workerID]
+// ReleaseWorker returns a worker after a request. Workers that failed meanwhile
+// are not handed out again until they report ready.
+func (wm *WorkerManager) ReleaseWorker(workerID WorkerId) {
+	worker, ok := wm.getWorker(workerID)
 	if ok {
+		worker.SetAvailable()
+
+		wm.dispatchers[worker.Model.Name].release(worker)
+	}
+}
+
+// WorkerReady is called when the model of a worker is loaded. Workers of models
+// with warmup requests take requests once they answered all of them, and are
+// restarted if one fails. A worker already warming up is not warmed up twice.
+func (wm *WorkerManager) WorkerReady(workerID WorkerId) {
+	worker, ok := wm.getWorker(workerID)
+	if !ok || worker.Model.Warmup == nil {
+		wm.SetWorkerAvailable(workerID)
+		return
+	}
+
+	if !worker.beginWarmup() {
+		return
+	}
+	go func() {
+		defer worker.endWarmup()
+		start := time.Now()
+		if err := worker.warmUp(context.Background(), worker.Model.Warmup.Requests); err != nil {
+			wm.logger.Error(fmt.Sprintf("Worker %s: warmup failed: %v", worker.ID, err))
+			wm.failedWorkerChan <- worker.ID
+			return
+		}
+		wm.logger.Info(fmt.Sprintf("Worker %s: warmed up with %d requests in %s", worker.ID, len(worker.Model.Warmup.Requests), time.Since(start)))
+		wm.SetWorkerAvailable(workerID)
+	}()
+}
+
+// SetWorkerAvailable marks a worker as loaded and ready to take requests.
+// Workers of a rollout wait for the switch before they take requests.
+func (wm *WorkerManager) SetWorkerAvailable(workerID WorkerId) {
+	worker, ok := wm.getWorker(workerID)
+	if ok && !worker.IsRetired() {
 		worker.SetLoaded()
 		worker.SetAvailable()
+		if worker.isStandby() {
+			return
+		}
+
+		wm.dispatchers[worker.Model.Name].release(worker)
+	}
+}
+
+type WorkerStatus struct {
+	ID       WorkerId         `json:"id"`
+	Model    models.ModelName `json:"model"`
+	Runtime  string           `json:"runtime"`
+	Address  string           `json:"address"`
+	Launched bool             `json:"launched"`
+	Loaded   bool             `json:"loaded"`
+	Busy     bool             `json:"busy"`
+	Lifetime string           `json:"lifetime"`
+}
 
-		wm.workerAvailableChan[worker.Model.Name] <- workerID
+// WorkersStatus reports the state of all workers for the admin API.
+func (wm *WorkerManager) WorkersStatus() []WorkerStatus {
+	workers := wm.workerList()
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+
+	statuses := make([]WorkerStatus, 0, len(workers))
+	for _, worker := range workers {
+		status := WorkerStatus{
+			ID:       worker.ID,
+			Model:    worker.Model.Name,
+			Runtime:  worker.Model.Runtime,
+			Address:  worker.Address(),
+			Launched: worker.IsLaunched(),
+			Loaded:   worker.IsLoaded(),
+			Busy:     worker.IsBusy(),
+		}
+		if status.Launched {
+			status.Lifetime = worker.ElapsedTimeString()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// TenantsStatus reports per-tenant queue and usage statistics of every model.
+func (wm *WorkerManager) TenantsStatus() map[models.ModelName][]TenantStatus {
+	statuses := make(map[models.ModelName][]TenantStatus)
+	for _, modelName := range wm.modelNames {
+		statuses[modelName] = wm.dispatchers[modelName].tenantsStatus()
+	}
+	return statuses
+}
+
+// ModelsStatus reports the queue and prediction statistics and the circuit
+// breaker state of every model, the statistics of the traffic splits by variant
+// and the prediction statistics of the pipelines.
+func (wm *WorkerManager) ModelsStatus() []ModelStatus {
+	statuses := make([]ModelStatus, 0, len(wm.modelNames))
+	for _, modelName := range wm.modelNames {
+		status := wm.stats[modelName].status()
+		status.Model = modelName
+		status.Queued, status.IdleWorkers = wm.dispatchers[modelName].stats()
+		if breaker, ok := wm.breakers[modelName]; ok {
+			status.Circuit, status.CircuitReason = breaker.status()
+		}
+		statuses = append(statuses, status)
+	}
+	for _, split := range wm.splits {
+		statuses = append(statuses, split.status())
+	}
+	for _, p := range wm.pipelines {
+		status := p.stats.status()
+		status.Model = p.name
+		statuses = append(statuses, status)
 	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Model < statuses[j].Model })
+	return statuses
 }
@@ -0,0 +1,313 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"model-hub/config"
+	"model-hub/models"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// echo answers a prediction with its instances.
+func echo(request models.PredictRequest) (interface{}, error) {
+	return models.PredictResponse{Predictions: request.Instances}, nil
+}
+
+// registerTestFunction registers fn for the duration of the test.
+func registerTestFunction(t testing.TB, name string, fn PredictFunc) {
+	t.Helper()
+	RegisterFunction(name, fn)
+	t.Cleanup(func() {
+		functionsMu.Lock()
+		defer functionsMu.Unlock()
+		delete(functions, name)
+	})
+}
+
+// newTestManager loads the configuration and handles worker events, without
+// starting the workers.
+func newTestManager(t testing.TB, configYAML string) *WorkerManager {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wm := NewWorkerManager(cfg, zap.NewNop())
+	go wm.handleFailedWorker()
+	go wm.handleReadyWorker()
+	return wm
+}
+
+// startTestManager loads the configuration and starts its workers, without the
+// resource monitoring of Initialize.
+func startTestManager(t testing.TB, configYAML string) *WorkerManager {
+	t.Helper()
+	wm := newTestManager(t, configYAML)
+	wm.startWorkersParallel()
+	for _, model := range wm.models {
+		waitForIdleWorkers(t, wm, model.Name, model.Workers)
+	}
+	return wm
+}
+
+func waitForIdleWorkers(t testing.TB, wm *WorkerManager, model models.ModelName, workers int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, idle := wm.dispatchers[model].stats(); idle >= workers {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("model %s: workers did not become idle", model)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// setRestartDelay shortens the restart delay for the duration of the test. The
+// test must wait until its workers are restarted.
+func setRestartDelay(t testing.TB, delay time.Duration) {
+	t.Helper()
+	previous := restartDelay
+	restartDelay = delay
+	t.Cleanup(func() { restartDelay = previous })
+}
+
+func TestRemovedWorkerReleasesTenantSlot(t *testing.T) {
+	registerTestFunction(t, "echo", echo)
+	wm := startTestManager(t, `
+models:
+  m:
+    name: "m"
+    runtime: "function"
+    function: "echo"
+    workers: 2
+    tenants:
+      a: {max_concurrent: 1}
+`)
+	options := RequestOptions{Tenant: "a"}
+	worker, err := wm.GetAvailableWorker(context.Background(), "m", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a busy worker removed on heartbeat expiry or after a rollout drain
+	wm.removeWorker(worker)
+	wm.ReleaseWorker(worker.ID)
+
+	if running := tenantStatus(wm.dispatchers["m"], "a").Running; running != 0 {
+		t.Fatalf("tenant a still has %d running requests", running)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	next, err := wm.GetAvailableWorker(ctx, "m", options)
+	if err != nil {
+		t.Fatalf("tenant a is still blocked: %v", err)
+	}
+	wm.ReleaseWorker(next.ID)
+}
+
+func TestConcurrentPredictFailuresAndStatus(t *testing.T) {
+	setRestartDelay(t, 10*time.Millisecond)
+	registerTestFunction(t, "jitter", func(request models.PredictRequest) (interface{}, error) {
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		return models.PredictResponse{Predictions: request.Instances}, nil
+	})
+	wm := startTestManager(t, `
+models:
+  m:
+    name: "m"
+    runtime: "function"
+    function: "jitter"
+    workers: 4
+    tenants:
+      a: {weight: 2}
+      b: {weight: 1, max_concurrent: 2}
+`)
+
+	started := time.Now()
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				wm.WorkersStatus()
+				wm.TenantsStatus()
+				wm.ModelsStatus()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	go func() {
+		// crash a worker now and then, as a failed process would
+		defer background.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				wm.failedWorkerChan <- WorkerId(fmt.Sprintf("m-%d", i%4+1))
+			}
+		}
+	}()
+
+	var requests sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		requests.Add(1)
+		go func(i int) {
+			defer requests.Done()
+			options := RequestOptions{Priority: i % 5, Tenant: []string{"a", "b"}[i%2]}
+			result, err := wm.Predict(context.Background(), "m", options, []byte(`{"instances":[1]}`))
+			if errors.Is(err, ErrTenantLimit) && options.Tenant == "b" {
+				return
+			}
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			if _, err := io.ReadAll(result.Body); err != nil {
+				t.Errorf("request %d: %v", i, err)
+			}
+			result.Body.Close()
+			wm.ReleaseWorker(result.Worker.ID)
+		}(i)
+	}
+	requests.Wait()
+	close(stop)
+	background.Wait()
+
+	waitForIdleWorkers(t, wm, "m", 4)
+	for _, tenant := range []string{"a", "b"} {
+		if status := tenantStatus(wm.dispatchers["m"], tenant); status.Queued != 0 || status.Running != 0 {
+			t.Errorf("tenant %s: %d queued and %d running requests left", tenant, status.Queued, status.Running)
+		}
+	}
+	restarted := 0
+	for _, worker := range wm.workerList() {
+		worker.mu.Lock()
+		if worker.startTime.After(started) {
+			restarted++
+		}
+		worker.mu.Unlock()
+	}
+	if restarted == 0 {
+		t.Error("no worker was restarted after a failure")
+	}
+	a, b := tenantStatus(wm.dispatchers["m"], "a"), tenantStatus(wm.dispatchers["m"], "b")
+	if handled := a.Served + b.Served + b.Rejected; handled < 500 {
+		t.Errorf("%d requests served or rejected, want at least 500", handled)
+	}
+}
+
+func TestFailedRestartIsRetried(t *testing.T) {
+	setRestartDelay(t, 10*time.Millisecond)
+	registerTestFunction(t, "vanishing", func(request models.PredictRequest) (interface{}, error) {
+		return models.PredictResponse{Predictions: request.Instances}, nil
+	})
+	wm := startTestManager(t, `
+models:
+  m:
+    name: "m"
+    runtime: "function"
+    function: "vanishing"
+    workers: 1
+`)
+	// the worker can not be started again until the function is back
+	functionsMu.Lock()
+	fn := functions["vanishing"]
+	delete(functions, "vanishing")
+	functionsMu.Unlock()
+	wm.failedWorkerChan <- "m-1"
+
+	time.Sleep(10 * restartDelay)
+	if _, idle := wm.dispatchers["m"].stats(); idle != 0 {
+		t.Fatal("worker handed out while it could not be started")
+	}
+	RegisterFunction("vanishing", fn)
+	waitForIdleWorkers(t, wm, "m", 1)
+}
+
+func TestHedgeCountsTowardsDefaultTenant(t *testing.T) {
+	registerTestFunction(t, "slow", func(request models.PredictRequest) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return models.PredictResponse{Predictions: request.Instances}, nil
+	})
+	wm := startTestManager(t, `
+models:
+  m:
+    name: "m"
+    runtime: "function"
+    function: "slow"
+    workers: 2
+    hedge: {min_delay: 1ms}
+    tenants:
+      default: {max_concurrent: 1}
+`)
+	for i := 0; i < minLatencySamples; i++ {
+		wm.stats["m"].observe(time.Millisecond)
+	}
+	result, err := wm.Predict(context.Background(), "m", RequestOptions{}, []byte(`{"instances":[1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Body.Close()
+	wm.ReleaseWorker(result.Worker.ID)
+
+	if status := tenantStatus(wm.dispatchers["m"], config.DefaultTenant); status.Served != 1 {
+		t.Errorf("default tenant: %+v, want 1 request served without a hedge", status)
+	}
+	if hedged := wm.ModelsStatus()[0].Hedged; hedged != 0 {
+		t.Errorf("%d hedged requests, want none over the default tenant's max_concurrent", hedged)
+	}
+}
+
+func TestSequentialStartDoesNotWaitForRemoteWorkers(t *testing.T) {
+	registerTestFunction(t, "echo", echo)
+	wm := newTestManager(t, `
+models:
+  r:
+    name: "r"
+    runtime: "remote"
+    workers: 1
+    endpoints: ["http://127.0.0.1:1"]
+  m:
+    name: "m"
+    runtime: "function"
+    function: "echo"
+    workers: 1
+`)
+	t.Cleanup(func() {
+		for _, worker := range wm.workerList() {
+			worker.Stop()
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wm.startWorkersSequentially()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sequential start is waiting for the unreachable remote worker")
+	}
+	waitForIdleWorkers(t, wm, "m", 1)
+}